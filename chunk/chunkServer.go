@@ -5,28 +5,60 @@ import (
 	"./chunk"
 //	"http"
 	"rpc"
-//	"os"
+	"os"
 	"log"
 	"net"
 //	"fmt"
 	"flag"
+	"strings"
 //	"strconv"
 )
 
 var logging *bool = flag.Bool("log", false, "enables logging")
+var dataDir *string = flag.String("data", "", "directory to keep chunks in (default chunks-<host>)")
+var syncFlag *string = flag.String("sync", "file", "when to fsync chunk writes: none, file or all")
+var space *uint64 = flag.Uint64("space", 1024*1024*1024, "bytes of chunk data this server may hold")
+var domain *string = flag.String("domain", "", "failure domain (rack, zone) this server sits in")
+var scrubRate *int64 = flag.Int64("scrubrate", 4*1024*1024, "bytes per second the background scrubber may read (0 disables it)")
 
 func main() {
 
 	flag.Parse()
-	masterAddress := flag.Arg(0)
+	//one or more masters, comma separated, primary first
+	masters := strings.Split(flag.Arg(0), ",", -1)
+
+	syncMode := chunk.SYNC_FILE
+	switch *syncFlag {
+	case "none":
+		syncMode = chunk.SYNC_NONE
+	case "file":
+		syncMode = chunk.SYNC_FILE
+	case "all":
+		syncMode = chunk.SYNC_ALL
+	default:
+		log.Fatal("chunk: unknown sync mode ", *syncFlag)
+	}
+
+	//servers sharing a working directory mustn't share a store
+	if *dataDir == "" {
+		host, _ := os.Hostname()
+		*dataDir = "chunks-" + host
+	}
+
+	err := chunk.OpenStore(*dataDir, syncMode, *space)
+	if err != nil {
+		log.Fatal("chunk: unable to open store: ", err)
+	}
 
 	chunkServ := new(chunk.Server)
+	chunk.SetDomain(*domain)
 	if *logging {
-		chunk.Init(masterAddress, true)
+		chunk.Init(masters, true)
 	}else{
-		chunk.Init(masterAddress, false)
+		chunk.Init(masters, false)
 	}
-	go chunk.SendHeartbeat(masterAddress)
+	go chunk.SendHeartbeat()
+	chunk.StartScrubber(*scrubRate)
 
 	rpc.Register(chunkServ)
 	
@@ -3,7 +3,6 @@ package chunk
 import (
 	"../include/sfs" 
 	"os"
-	"rpc"
 	"log"
 	"net"
 //	"fmt"
@@ -14,6 +13,8 @@ import (
 //	"flag"
 	"../logger/logger"
 	"os/signal"
+	"crypto/sha256"
+	"sync"
 )
 
 type Server int
@@ -24,17 +25,28 @@ const STATUS_ARGS = ""
 const STATUS_LEN = 17
 const THRESHOLD = 15 //represents value out of 20
 
-var chunkTable = map[uint64] sfs.Chunk {}
-var capacity uint64
-var addedChunks vector.Vector
+var capacity uint64 // chunks the server has room for, under capacityLock
+var capacityLock sync.Mutex
+var addedChunks = new(vector.Vector) // chunks stored since the last heartbeat, under addedLock
+var addedLock sync.Mutex
 var chunkServerID uint64
 var logging bool
 var requestLoad int
 var loadArray []int
 var loadArrayIndex int
 var tcpAddr *net.TCPAddr
+var masters []string
+var masterIndex int // guarded by masterLock
+var masterLock sync.Mutex
+var failureDomain string
+
+// SetDomain sets the failure domain advertised to the master. It must be
+// called before Init.
+func SetDomain(domain string) {
+	failureDomain = domain
+}
 
-func Init(masterAddress string, loggingFlag bool) {
+func Init(masterAddrs []string, loggingFlag bool) {
 
 	var args sfs.ChunkBirthArgs
 	var ret sfs.ChunkBirthReturn 
@@ -46,9 +58,16 @@ func Init(masterAddress string, loggingFlag bool) {
 	}
 	loadArrayIndex = 0
 	logging = loggingFlag
+	masters = masterAddrs
 
-	capacity = CHUNK_TABLE_SIZE
-	args.Capacity = capacity
+	capacityLock.Lock()
+	capacity = CHUNK_TABLE_SIZE - uint64(store.Len())
+	capacityLock.Unlock()
+	args.Capacity = getCapacity()
+	args.BytesUsed, args.BytesLimit = store.Space()
+	args.Domain = failureDomain
+	//anything already on disk is ours; tell the master up front
+	args.Chunks = store.Inventory()
 
 	host,_ := os.Hostname()
 	_,iparray,_ := net.LookupHost(host)
@@ -72,15 +91,7 @@ func Init(masterAddress string, loggingFlag bool) {
 
 	go sigHandler()
 
-	master, err := rpc.Dial("tcp", masterAddress + ":1338")
-	if master != nil {
-		defer master.Close()
-	}
-	if err != nil {
-		log.Fatal("chunk dial error:", err)
-	}
-
-	err = master.Call("Master.BirthChunk", &args, &ret)
+	err := callMaster("Master.BirthChunk", &args, &ret)
 	if err != nil {
 		log.Fatal("chunk call error: ", err)
 	}
@@ -103,12 +114,24 @@ func (t *Server) Read(args *sfs.ReadArgs, ret *sfs.ReadReturn) os.Error {
 	}
 	log.Println("chunk: Reading from chunk", args.ChunkID)
 
-	data,present := chunkTable[args.ChunkID]
+	data,version,present,err := store.Get(args.ChunkID, args.Offset, args.Length)
 	if !present{
 		ret.Status = sfs.FAIL
 		log.Println("chunk: Invalid read request chunk", args.ChunkID)
 		return nil
 	}
+	if err == errCorrupt {
+		//the reader tries another copy; the master hears with the next heartbeat
+		ret.Status = sfs.FAIL
+		log.Println("chunk: chunk", args.ChunkID, "is corrupt")
+		reportBadChunk(args.ChunkID)
+		return nil
+	}
+	if err != nil {
+		ret.Status = sfs.FAIL
+		log.Println("chunk: unable to read chunk", args.ChunkID, err)
+		return nil
+	}
 
 
 	/*if args.Nice == sfs.NICE && ServerBusy() {
@@ -117,7 +140,8 @@ func (t *Server) Read(args *sfs.ReadArgs, ret *sfs.ReadReturn) os.Error {
 		return nil
 	}*/
 	
-	ret.Data.Data = data.Data
+	ret.Data.Data = data
+	ret.Version = version
 	ret.Status = sfs.SUCCESS
 	log.Println("chunk: Read success")
 	/*if logging {
@@ -136,19 +160,28 @@ func (t *Server) Write(args *sfs.WriteArgs, ret *sfs.WriteReturn) os.Error {
 
 	id = logger.Start("Write")
 	log.Println("chunk: Writing to chunk ", args.Info.ChunkID)
-	if (capacity < 1) {
+	if (getCapacity() < 1) {
 		log.Println("chunk: Server Full!")
 		return nil
 	}
 	
-	data,present := chunkTable[args.Info.ChunkID]
-	if !present{
-		addedChunks.Push(args.Info)
-		capacity --
+	if len(args.Data.Data) > sfs.MAX_CHUNK_SIZE {
+		log.Println("chunk: refusing oversized chunk", args.Info.ChunkID)
+		logger.End(id, false)
+		return nil
 	}
 
-	data.Data = args.Data.Data
-	chunkTable[args.Info.ChunkID] = data
+	added,err := store.Put(args.Info.ChunkID, args.Info.Version, args.Info.Hash, args.Data.Data)
+	if err != nil {
+		log.Println("chunk: unable to store chunk", args.Info.ChunkID, err)
+		logger.End(id, false)
+		return nil
+	}
+	//report rewrites too, so the master sees the new version
+	noteAdded(args.Info)
+	if added {
+		addCapacity(-1)
+	}
 
 	tempServ := args.Info.Servers[0]
 	var inRet sfs.WriteReturn
@@ -158,14 +191,8 @@ func (t *Server) Write(args *sfs.WriteArgs, ret *sfs.WriteReturn) os.Error {
 			break
 		}
 		args.Info.Servers = args.Info.Servers[1:len(args.Info.Servers)]
-		client, err := rpc.Dial("tcp", args.Info.Servers[0].String())
-		if err != nil {
-			log.Println("chunk: dialing error: ", err)
-			continue
-		}
 		log.Println("chunk: forwarding write to ", args.Info.Servers[0])
-		err = client.Call("Server.Write", &args, &inRet)
-	        client.Close()
+		err := sfs.Conns.Call(args.Info.Servers[0].String(), "Server.Write", &args, &inRet)
 		if err != nil {
 			log.Println("chunk: server error: ", err)
 			continue
@@ -237,17 +264,71 @@ func LogStats(){
 	logFile.Close();		
 }
 
-func SendHeartbeat(masterAddress string){
-	var args sfs.HeartbeatArgs
-	var ret  sfs.HeartbeatReturn
-	
-	master, err := rpc.Dial("tcp", masterAddress + ":1338")
-	if(master != nil){
-		defer master.Close()
+// callMaster makes an RPC against the current master, moving down the list
+// when a master is unreachable or turns out to be a standby. A call lost
+// in flight is only made again if sfs.Retry says that is safe.
+func callMaster(method string, args interface{}, reply interface{}) os.Error {
+	masterLock.Lock()
+	index := masterIndex
+	masterLock.Unlock()
+
+	var err os.Error
+	for i := 0; i < len(masters); i++ {
+		addr := masters[index]
+
+		err = sfs.Conns.Call(sfs.MasterAddr(addr), method, args, reply)
+		if err == nil || (err.String() != sfs.ERR_STANDBY && !sfs.Retry(method, err)) {
+			break
+		}
+
+		log.Println("chunk: master", addr, "unavailable:", err)
+		index = (index + 1) % len(masters)
 	}
-	if err != nil {
-		log.Fatal("chunk: dialing:", err)
+
+	masterLock.Lock()
+	masterIndex = index
+	masterLock.Unlock()
+
+	return err
+}
+
+// noteAdded queues a chunk stored or rewritten here for the next
+// heartbeat.
+func noteAdded(info sfs.ChunkInfo) {
+	addedLock.Lock()
+	defer addedLock.Unlock()
+
+	addedChunks.Push(info)
+}
+
+// takeAdded hands over every chunk queued since the last heartbeat and
+// starts a fresh queue.
+func takeAdded() []sfs.ChunkInfo {
+	addedLock.Lock()
+	defer addedLock.Unlock()
+
+	added := make([]sfs.ChunkInfo, addedChunks.Len())
+	for i := 0; i < addedChunks.Len(); i++ {
+		added[i] = addedChunks.At(i).(sfs.ChunkInfo)
+	}
+	addedChunks = new(vector.Vector)
+	return added
+}
+
+// requeueAdded puts back chunks the master never heard about.
+func requeueAdded(added []sfs.ChunkInfo) {
+	addedLock.Lock()
+	defer addedLock.Unlock()
+
+	for _, info := range added {
+		addedChunks.Push(info)
 	}
+}
+
+func SendHeartbeat(){
+	var args sfs.HeartbeatArgs
+	var ret  sfs.HeartbeatReturn
+	var err os.Error
 
 	host,_ := os.Hostname()
 	_,iparray,_ := net.LookupHost(host)
@@ -261,43 +342,51 @@ func SendHeartbeat(masterAddress string){
 			id = logger.Start("Heart")
 		}
 
-		args.Capacity = capacity
-		addedChunkSlice := make([]sfs.ChunkInfo, addedChunks.Len())
-		for i := 0; i < addedChunks.Len(); i++ {
-			addedChunkSlice[i] = addedChunks.At(i).(sfs.ChunkInfo)
-		}
-		args.AddedChunks = addedChunkSlice
-		err = master.Call("Master.BeatHeart", &args, &ret)
+		args.Capacity = getCapacity()
+		args.BytesUsed, args.BytesLimit = store.Space()
+		args.AddedChunks = takeAdded()
+		bad, missing := scrubReport()
+		args.BadChunks, args.MissingChunks = bad, missing
+		err = callMaster("Master.BeatHeart", &args, &ret)
 		if err != nil {
-			log.Fatal("chunk: heartbeat error: ", err)
+			//no master is answering; keep our state and try again
+			log.Println("chunk: heartbeat error: ", err)
+			requeueAdded(args.AddedChunks)
+			requeueScrubReport(bad, missing)
+			time.Sleep(sfs.HEARTBEAT_WAIT)
+			continue
 		}
 		if ret.Accepted == false {
+			requeueScrubReport(bad, missing)
 			var bArgs sfs.ChunkBirthArgs
 			var bRet sfs.ChunkBirthReturn
 			host,_ := os.Hostname()
 			_,iparray,_ := net.LookupHost(host)
 			tcpAddr,_ := net.ResolveTCPAddr(iparray[0] + ":1337")
 			bArgs.ChunkServerIP = *tcpAddr
-			bArgs.ChunkIDs = make([]uint64, len(chunkTable))
-			i := 0
-			for k, _ := range chunkTable {
-				bArgs.ChunkIDs[i] = k
-				i++
-			}
+			bArgs.Capacity = getCapacity()
+			bArgs.BytesUsed, bArgs.BytesLimit = store.Space()
+			bArgs.Domain = failureDomain
+			bArgs.Chunks = store.Inventory()
 			log.Println("chunk: heartbeat")
-			err = master.Call("Master.BirthChunk", &bArgs, &bRet)
+			err = callMaster("Master.BirthChunk", &bArgs, &bRet)
 			if err != nil {
-				log.Fatal("chunk call error:", err)
+				log.Println("chunk call error:", err)
+				time.Sleep(sfs.HEARTBEAT_WAIT)
+				continue
 			}
 			chunkServerID = bRet.ChunkServerID
 		} else if ret.ChunksToRemove != nil {
 			for i := 0; i < ret.ChunksToRemove.Len(); i++ {
-				chunkTable[ret.ChunksToRemove.At(i).(uint64)] = 
-					sfs.Chunk{}, false
-				capacity++
+				removed, err := store.Remove(ret.ChunksToRemove.At(i).(uint64))
+				if err != nil {
+					log.Println("chunk: unable to remove chunk", ret.ChunksToRemove.At(i), err)
+				}
+				if removed {
+					addCapacity(1)
+				}
 			}
 		}
-		addedChunks.Resize(0, 0)
 		if logging {
 			errString := logger.End(id, false)
 			if errString != "" {
@@ -313,15 +402,16 @@ func SendHeartbeat(masterAddress string){
 
 func (t *Server) ReplicateChunk(args *sfs.ReplicateChunkArgs, ret *sfs.ReplicateChunkReturn) os.Error {
 	requestLoad++
+	ret.Status = sfs.FAIL
 	if args.Servers == nil {
 		log.Println("chunk: replication call: nil address.")
 		return nil
 	}
 	
 	log.Println("chunk: replication request chunk", args.ChunkID);
-	_,present := chunkTable[args.ChunkID]
-	if present {
+	if version, ok := store.Version(args.ChunkID); ok && version == args.Version {
 		log.Println("chunk: already have it!");
+		ret.Status = sfs.SUCCESS
 		return nil
 	}
 	
@@ -330,47 +420,62 @@ func (t *Server) ReplicateChunk(args *sfs.ReplicateChunkArgs, ret *sfs.Replicate
 			continue;
 		}
 		
-		replicationHost, err := rpc.Dial("tcp", args.Servers[i].String())
-		if(replicationHost != nil){
-			defer replicationHost.Close()
-		}
-		if err != nil {
-			log.Println("chunk: replication error", err)
-			continue
-		}
-		
 		var readArgs sfs.ReadArgs
 		var readRet sfs.ReadReturn
 		readArgs.ChunkID = args.ChunkID
 		readArgs.Nice = sfs.FORCE
 		log.Println("chunk: replicating from", args.Servers[i]);
-		err = replicationHost.Call("Server.Read", &readArgs, &readRet)
+		err := sfs.Conns.Call(args.Servers[i].String(), "Server.Read", &readArgs, &readRet)
+		if err != nil {
+			log.Println("chunk: replication error", err)
+			continue
+		}
+		if readRet.Status != sfs.SUCCESS {
+			log.Println("chunk: replication source", args.Servers[i], "does not have chunk", args.ChunkID)
+			continue
+		}
+		//the master hands out versions, so any other is stale or corrupt
+		if readRet.Version != args.Version {
+			log.Println("chunk: replication source", args.Servers[i], "has chunk", args.ChunkID, "at version", readRet.Version, "not", args.Version)
+			continue
+		}
+		if args.Hash != nil {
+			hasher := sha256.New()
+			hasher.Write(readRet.Data.Data)
+			if string(hasher.Sum()) != string(args.Hash) {
+				log.Println("chunk: replication source", args.Servers[i], "has corrupt chunk", args.ChunkID)
+				continue
+			}
+		}
+
+		added, err := store.Put(args.ChunkID, readRet.Version, args.Hash, readRet.Data.Data)
 		if err != nil {
 			log.Println("chunk: replication error", err)
 			continue
 		}
 		log.Println("chunk: replication complete")
 
-		chunkTable[args.ChunkID] = readRet.Data
 		var info sfs.ChunkInfo
 		info.ChunkID = readArgs.ChunkID
-		addedChunks.Push(info)
-		capacity--
+		info.Version = readRet.Version
+		noteAdded(info)
+		if added {
+			addCapacity(-1)
+		}
+		ret.Status = sfs.SUCCESS
 		break
 	}
 	return nil
 }
 
+// ServerBusy reports whether the server is loaded enough that background
+// work should wait. The scrubber asks before every chunk, so it stays
+// quiet.
 func ServerBusy() bool {
-	log.Println("Chunk: calculating load...")
     loggerLoad := logger.GetLoad()
-    chunkLoad := getAvgReq()
-    log.Println("Chunk: logger metric says: ", loggerLoad)
-    log.Println("Chunk: chunk metric says: ", chunkLoad)
 
 	index := loggerLoad * 2
 //	index := requestLoad
-	log.Println("Chunk: server load index", index)
 
 	return index > THRESHOLD
 }
@@ -382,7 +487,6 @@ func getAvgReq() int {
 		avg += float64(loadArray[i])
 	}
     avg = avg/3.0
-    log.Println("avg is: ", avg)
 	//use loadArrayIndex -1 for most recent reading
 	var currentVal float64
 	if loadArrayIndex == 0 {
@@ -390,7 +494,6 @@ func getAvgReq() int {
 	} else {
 		currentVal = float64(loadArray[loadArrayIndex -1])
 	}
-    log.Println("currentVal is: ", currentVal)
 	if currentVal > avg {
 		retVal := int(10.0 * (currentVal - avg)/avg)
         if (retVal > 10){
@@ -424,3 +527,18 @@ func sigHandler() {
 
 	}
 }
+
+func getCapacity() uint64 {
+	capacityLock.Lock()
+	defer capacityLock.Unlock()
+
+	return capacity
+}
+
+// addCapacity changes the number of chunks the server has room for by n.
+func addCapacity(n int) {
+	capacityLock.Lock()
+	defer capacityLock.Unlock()
+
+	capacity += uint64(n)
+}
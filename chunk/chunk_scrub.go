@@ -0,0 +1,105 @@
+package chunk
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const SCRUB_PASS_WAIT = 60 * 60 * 1000000000 // 1 hour between passes over the store
+const SCRUB_BUSY_WAIT = 10 * 1000000000      // back off this long while the server is busy
+
+var scrubLock sync.Mutex
+var badChunks []uint64
+var missingChunks []uint64
+
+// StartScrubber walks the store in the background, rereading every chunk
+// and checking it against the hash it was written with. It reads at most
+// rate bytes a second and stands aside whenever ServerBusy says clients
+// need the disk. Problems go to the master with the next heartbeat.
+func StartScrubber(rate int64) {
+	if rate <= 0 {
+		log.Println("chunk: scrubber disabled")
+		return
+	}
+
+	go scrub(rate)
+}
+
+func scrub(rate int64) {
+	for {
+		start := time.Nanoseconds()
+		checked := 0
+
+		for _, info := range store.Inventory() {
+			for ServerBusy() {
+				time.Sleep(SCRUB_BUSY_WAIT)
+			}
+
+			good, present, size, err := store.Verify(info.ChunkID)
+			if err == errGone {
+				//removed since the inventory was taken
+				continue
+			}
+			if err != nil {
+				log.Println("chunk: scrubber unable to check chunk", info.ChunkID, err)
+				continue
+			}
+
+			if !present {
+				addCapacity(1)
+			}
+
+			scrubLock.Lock()
+			if !present {
+				log.Println("chunk: scrubber found chunk", info.ChunkID, "missing")
+				missingChunks = append(missingChunks, info.ChunkID)
+			} else if !good {
+				log.Println("chunk: scrubber found chunk", info.ChunkID, "corrupt")
+				badChunks = append(badChunks, info.ChunkID)
+			}
+			scrubLock.Unlock()
+
+			checked++
+			time.Sleep(size * 1000000000 / rate)
+		}
+
+		log.Println("chunk: scrubbed", checked, "chunks in", (time.Nanoseconds()-start)/1000000000, "seconds")
+		time.Sleep(SCRUB_PASS_WAIT)
+	}
+}
+
+// reportBadChunk queues a chunk found corrupt outside the scrubber, by a
+// read, for the next heartbeat.
+func reportBadChunk(id uint64) {
+	scrubLock.Lock()
+	defer scrubLock.Unlock()
+
+	for _, bad := range badChunks {
+		if bad == id {
+			return
+		}
+	}
+	badChunks = append(badChunks, id)
+}
+
+// scrubReport hands over everything the scrubber has found since the last
+// heartbeat.
+func scrubReport() (bad []uint64, missing []uint64) {
+	scrubLock.Lock()
+	defer scrubLock.Unlock()
+
+	bad, missing = badChunks, missingChunks
+	badChunks, missingChunks = nil, nil
+
+	return bad, missing
+}
+
+// requeueScrubReport puts back findings the master never heard about.
+func requeueScrubReport(bad []uint64, missing []uint64) {
+	scrubLock.Lock()
+	defer scrubLock.Unlock()
+
+	badChunks = append(badChunks, bad...)
+	missingChunks = append(missingChunks, missing...)
+}
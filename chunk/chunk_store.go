@@ -0,0 +1,452 @@
+package chunk
+
+import (
+	"os"
+	"io"
+	"io/ioutil"
+	"encoding/binary"
+	"crypto/sha256"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"../include/sfs"
+)
+
+//how hard Put works to get a chunk onto stable storage
+const (
+	SYNC_NONE = iota // leave it to the page cache
+	SYNC_FILE        // fsync the chunk file before renaming it into place
+	SYNC_ALL         // also fsync the directory so the rename survives a crash
+)
+
+const tmpSuffix = ".tmp"
+const hashLen = sha256.Size
+
+// Each chunk file starts with a header: a magic number, the layout of the
+// file, then the chunk's big endian version and the hash it was written
+// with (zeros if unknown). The data follows.
+const (
+	chunkMagic  = "SFSC"
+	storeFormat = 1
+	headerLen   = 4 + 4 + 8 + hashLen
+)
+
+var errUnmarked = os.NewError("chunk file has no magic number")
+var errFormat = os.NewError("chunk file is in a newer format")
+var errCorrupt = os.NewError("chunk does not match its hash")
+var errGone = os.NewError("chunk no longer held")
+
+// chunkStore keeps one file per chunk, named by chunk ID, in a single data
+// directory. Each file starts with a header holding the chunk's version
+// and the hash it was written with. Writes go to a temporary file that is
+// renamed over the old copy, so a reader never sees half a chunk.
+type chunkStore struct {
+	dir      string
+	syncMode int
+	lock     sync.Mutex
+	chunks   map[uint64]stored
+	bytes    uint64 // data held, headers excluded
+	limit    uint64 // most data the store may hold
+	tmpSeq   uint64 // numbers temporary files so concurrent Puts don't share one
+}
+
+type stored struct {
+	version uint64
+	size    uint64
+}
+
+var store *chunkStore
+
+// OpenStore opens (creating if needed) the chunk directory and scans it to
+// rebuild the inventory of chunks held from a previous run. limit caps the
+// bytes of chunk data the store takes. It must be called before Init.
+func OpenStore(dir string, syncMode int, limit uint64) os.Error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	s := new(chunkStore)
+	s.dir = dir
+	s.syncMode = syncMode
+	s.limit = limit
+	s.chunks = make(map[uint64]stored)
+
+	err = s.scan()
+	if err != nil {
+		return err
+	}
+
+	log.Println("chunk: store", dir, "holds", len(s.chunks), "chunks,", s.bytes, "bytes")
+
+	store = s
+	return nil
+}
+
+func (s *chunkStore) scan() os.Error {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range entries {
+		if !fi.IsRegular() {
+			continue
+		}
+
+		//leftovers from a write that never got renamed
+		if strings.HasSuffix(fi.Name, tmpSuffix) {
+			log.Println("chunk: removing stale", fi.Name)
+			os.Remove(path.Join(s.dir, fi.Name))
+			continue
+		}
+
+		id, err := strconv.Atoui64(fi.Name)
+		if err != nil {
+			log.Println("chunk: ignoring", fi.Name, "in store")
+			continue
+		}
+
+		size := uint64(0)
+		if fi.Size > headerLen {
+			size = uint64(fi.Size) - headerLen
+		}
+
+		version, _, err := s.readHeader(id)
+		if err == errUnmarked || err == errFormat {
+			//not ours to read, so not ours to delete either
+			log.Println("chunk: skipping", fi.Name, err)
+			continue
+		} else if err != nil {
+			log.Println("chunk: removing unreadable", fi.Name, err)
+			os.Remove(path.Join(s.dir, fi.Name))
+			continue
+		}
+
+		s.chunks[id] = stored{version, size}
+		s.bytes += size
+	}
+
+	return nil
+}
+
+func (s *chunkStore) readHeader(id uint64) (version uint64, hash []byte, err os.Error) {
+	f, err := os.Open(s.fileName(id), os.O_RDONLY, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	return readHeader(f)
+}
+
+func readHeader(f *os.File) (version uint64, hash []byte, err os.Error) {
+	var header [headerLen]byte
+	n, err := io.ReadFull(f, header[0:])
+	if n < len(chunkMagic) || string(header[0:len(chunkMagic)]) != chunkMagic {
+		return 0, nil, errUnmarked
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if binary.BigEndian.Uint32(header[4:8]) > storeFormat {
+		return 0, nil, errFormat
+	}
+
+	version, hash = versionAndHash(header[8:])
+	return version, hash, nil
+}
+
+// versionAndHash splits a big endian version from the hash that follows
+// it. A hash of all zeros means none was known, and comes back nil.
+func versionAndHash(b []byte) (version uint64, hash []byte) {
+	version = binary.BigEndian.Uint64(b[0:8])
+	for _, c := range b[8 : 8+hashLen] {
+		if c != 0 {
+			return version, b[8 : 8+hashLen]
+		}
+	}
+	return version, nil
+}
+
+func makeHeader(version uint64, hash []byte) []byte {
+	header := make([]byte, headerLen)
+	copy(header[0:4], chunkMagic)
+	binary.BigEndian.PutUint32(header[4:8], storeFormat)
+	binary.BigEndian.PutUint64(header[8:16], version)
+	if len(hash) == hashLen {
+		copy(header[16:], hash)
+	}
+	return header
+}
+
+func (s *chunkStore) fileName(id uint64) string {
+	return path.Join(s.dir, strconv.Uitoa64(id))
+}
+
+func (s *chunkStore) Has(id uint64) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, ok := s.chunks[id]
+	return ok
+}
+
+// Space reports the bytes of chunk data held and the most the store may
+// hold.
+func (s *chunkStore) Space() (used uint64, limit uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.bytes, s.limit
+}
+
+// Version reports the version of a chunk and whether the store holds it.
+func (s *chunkStore) Version(id uint64) (uint64, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, ok := s.chunks[id]
+	return c.version, ok
+}
+
+func (s *chunkStore) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.chunks)
+}
+
+// Inventory lists the ID and version of every chunk in the store.
+func (s *chunkStore) Inventory() []sfs.ChunkInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	held := make([]sfs.ChunkInfo, 0, len(s.chunks))
+	for id, c := range s.chunks {
+		var info sfs.ChunkInfo
+		info.ChunkID = id
+		info.Version = c.version
+		info.Size = c.size
+		held = append(held, info)
+	}
+	return held
+}
+
+// Get reads length bytes of a chunk starting at offset, or everything
+// from offset on if length is 0, along with the version of the copy read.
+// present is false if the store doesn't hold the chunk. The hash covers
+// the whole chunk, so all of it is read and checked even for a short
+// range, and a chunk that fails the check gives errCorrupt.
+func (s *chunkStore) Get(id uint64, offset uint64, length uint64) (data []byte, version uint64, present bool, err os.Error) {
+	if !s.Has(id) {
+		return nil, 0, false, nil
+	}
+
+	f, err := os.Open(s.fileName(id), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, 0, true, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, true, err
+	}
+
+	version, hash, err := readHeader(f)
+	if err != nil {
+		return nil, 0, true, err
+	}
+
+	size := uint64(fi.Size) - headerLen
+	all := make([]byte, size)
+	_, err = io.ReadFull(f, all)
+	if err != nil {
+		return nil, 0, true, err
+	}
+
+	if hash != nil {
+		hasher := sha256.New()
+		hasher.Write(all)
+		if string(hasher.Sum()) != string(hash) {
+			return nil, version, true, errCorrupt
+		}
+	}
+
+	if offset >= size {
+		return []byte{}, version, true, nil
+	}
+	if length == 0 || offset+length > size {
+		length = size - offset
+	}
+
+	return all[offset : offset+length], version, true, nil
+}
+
+// Put stores a chunk at the given version along with the hash it should
+// have, replacing any existing copy that is not newer. It reports whether
+// the chunk is new to the store. Puts of the same chunk may run at once:
+// each writes its own temporary file, and whether it may replace what is
+// there is decided under the lock, as it is renamed into place.
+func (s *chunkStore) Put(id uint64, version uint64, hash []byte, data []byte) (added bool, err os.Error) {
+	s.lock.Lock()
+	old, ok := s.chunks[id]
+	full := s.bytes-old.size+uint64(len(data)) > s.limit
+	s.lock.Unlock()
+
+	//fail early if we can; the checks that count are made again below
+	if ok && old.version > version {
+		return false, os.NewError("store holds a newer version of the chunk")
+	}
+	if full {
+		return false, os.NewError("store is full")
+	}
+
+	name := s.fileName(id)
+	tmpName, err := s.writeTemp(id, version, hash, data)
+	if err != nil {
+		return false, err
+	}
+
+	s.lock.Lock()
+	old, had := s.chunks[id]
+	if had && old.version > version {
+		err = os.NewError("store holds a newer version of the chunk")
+	} else if s.bytes-old.size+uint64(len(data)) > s.limit {
+		err = os.NewError("store is full")
+	} else {
+		err = os.Rename(tmpName, name)
+	}
+	if err != nil {
+		s.lock.Unlock()
+		os.Remove(tmpName)
+		return false, err
+	}
+	added = !had
+	s.bytes += uint64(len(data)) - old.size
+	s.chunks[id] = stored{version, uint64(len(data))}
+	s.lock.Unlock()
+
+	if s.syncMode >= SYNC_ALL {
+		err = s.syncDir()
+		if err != nil {
+			return added, err
+		}
+	}
+
+	return added, nil
+}
+
+// writeTemp writes a chunk file under a name of its own, ready to be
+// renamed into place.
+func (s *chunkStore) writeTemp(id uint64, version uint64, hash []byte, data []byte) (tmpName string, err os.Error) {
+	s.lock.Lock()
+	s.tmpSeq++
+	tmpName = s.fileName(id) + "." + strconv.Uitoa64(s.tmpSeq) + tmpSuffix
+	s.lock.Unlock()
+
+	f, err := os.Open(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = f.Write(makeHeader(version, hash))
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil && s.syncMode >= SYNC_FILE {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmpName)
+		return "", err
+	}
+
+	return tmpName, nil
+}
+
+// Verify rereads a chunk and checks it against the hash it was stored
+// with. present is false if the chunk has gone missing from disk, in which
+// case the store forgets it. A chunk stored without a hash always passes.
+// A chunk the store no longer holds, because it was removed, gives
+// errGone.
+func (s *chunkStore) Verify(id uint64) (good bool, present bool, size int64, err os.Error) {
+	if !s.Has(id) {
+		return false, false, 0, errGone
+	}
+
+	f, err := os.Open(s.fileName(id), os.O_RDONLY, 0)
+	if err != nil {
+		if pe, ok := err.(*os.PathError); ok && pe.Error == os.ENOENT {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+
+			//Remove takes it out of the inventory before deleting the file
+			old, held := s.chunks[id]
+			if !held {
+				return false, false, 0, errGone
+			}
+			s.bytes -= old.size
+			s.chunks[id] = stored{}, false
+			return false, false, 0, nil
+		}
+		return false, true, 0, err
+	}
+	defer f.Close()
+
+	_, hash, err := readHeader(f)
+	if err != nil {
+		//too short to even hold a header
+		return false, true, 0, nil
+	}
+
+	hasher := sha256.New()
+	size, err = io.Copy(hasher, f)
+	if err != nil {
+		return false, true, size, err
+	}
+
+	if hash == nil {
+		return true, true, size, nil
+	}
+
+	return string(hasher.Sum()) == string(hash), true, size, nil
+}
+
+// Remove deletes a chunk. It reports whether the store held it.
+func (s *chunkStore) Remove(id uint64) (removed bool, err os.Error) {
+	s.lock.Lock()
+	old, removed := s.chunks[id]
+	s.bytes -= old.size
+	s.chunks[id] = stored{}, false
+	s.lock.Unlock()
+
+	if !removed {
+		return false, nil
+	}
+
+	err = os.Remove(s.fileName(id))
+	if err != nil {
+		return true, err
+	}
+
+	if s.syncMode >= SYNC_ALL {
+		err = s.syncDir()
+	}
+
+	return true, err
+}
+
+func (s *chunkStore) syncDir() os.Error {
+	d, err := os.Open(s.dir, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
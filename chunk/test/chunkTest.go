@@ -21,7 +21,7 @@ func main() {
 	var ret sfs.WriteReturn
 	var args sfs.WriteArgs
 	args.Info.ChunkID = 12
-	args.Data.Data[0] = 'a'
+	args.Data.Data = []byte{'a'}
 
 	err = client.Call("Server.Write", &args, &ret)
 	if err != nil {
@@ -0,0 +1,249 @@
+package client
+
+import (
+	"container/vector"
+	"os"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+	"../include/sfs"
+)
+
+// cache remembers what the master said about files, their chunks and
+// where those live, and about directory listings. An entry is trusted for
+// the TTL; after that it is checked against the master's version before
+// being used again, which costs one small call rather than a refetch.
+// The client drops entries itself when it changes the namespace, and
+// refetches a file whose cached chunk servers no longer answer.
+type cache struct {
+	lock  sync.Mutex
+	ttl   int64 // ns, 0 or less caches nothing
+	files map[string](*cachedFile)
+	dirs  map[string](*cachedDir)
+}
+
+type cachedFile struct {
+	info    sfs.OpenReturn
+	access  uint64 // what the master let us open it for
+	checked int64  // last fetched or validated
+}
+
+type cachedDir struct {
+	names   []string
+	version uint64
+	checked int64
+}
+
+func newCache(ttl int64) *cache {
+	m := new(cache)
+	m.ttl = ttl
+	m.files = make(map[string](*cachedFile))
+	m.dirs = make(map[string](*cachedDir))
+	return m
+}
+
+// cacheKey puts a path in the form the master does, so "a/b" and "/a/b/"
+// share an entry.
+func cacheKey(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return path.Clean(p)
+}
+
+// cachedOpen returns the cached open of name if it allows access and is fresh,
+// or can be made fresh by validating it.
+func (c *Client) cachedOpen(name string, access uint64) (*sfs.OpenReturn, bool) {
+	m := c.cache
+	key := cacheKey(name)
+
+	m.lock.Lock()
+	entry, ok := m.files[key]
+	m.lock.Unlock()
+
+	if !ok || entry.access&access != access {
+		return nil, false
+	}
+	if time.Nanoseconds()-entry.checked > m.ttl {
+		versions, _, err := c.validate([]string{key}, nil)
+		if err != nil || versions[0] != entry.info.Version {
+			m.dropFile(key)
+			return nil, false
+		}
+		m.lock.Lock()
+		entry.checked = time.Nanoseconds()
+		m.lock.Unlock()
+	}
+
+	info := entry.info
+	return &info, true
+}
+
+// putOpen remembers what the master said when name was opened.
+func (m *cache) putOpen(name string, access uint64, info *sfs.OpenReturn) {
+	if m.ttl <= 0 || info.Version == 0 {
+		return
+	}
+
+	entry := new(cachedFile)
+	entry.info = *info
+	entry.info.New = false
+	entry.info.LeaseID = 0
+	entry.info.LeaseDuration = 0
+	entry.access = access
+	entry.checked = time.Nanoseconds()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := cacheKey(name)
+	if old, ok := m.files[key]; ok && old.info.Version == info.Version {
+		entry.access |= old.access
+	}
+	m.files[key] = entry
+}
+
+// cachedDir returns the cached listing of dir if it is fresh, or can be
+// made fresh by validating it.
+func (c *Client) cachedDir(dir string) ([]string, bool) {
+	m := c.cache
+	key := cacheKey(dir)
+
+	m.lock.Lock()
+	entry, ok := m.dirs[key]
+	m.lock.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+	if time.Nanoseconds()-entry.checked > m.ttl {
+		_, versions, err := c.validate(nil, []string{key})
+		if err != nil || versions[0] != entry.version {
+			m.dropDir(key)
+			return nil, false
+		}
+		m.lock.Lock()
+		entry.checked = time.Nanoseconds()
+		m.lock.Unlock()
+	}
+
+	return entry.names, true
+}
+
+func (m *cache) putDir(dir string, names []string, version uint64) {
+	if m.ttl <= 0 || version == 0 {
+		return
+	}
+
+	entry := &cachedDir{names, version, time.Nanoseconds()}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.dirs[cacheKey(dir)] = entry
+}
+
+func (m *cache) dropFile(name string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.files[cacheKey(name)] = nil, false
+}
+
+func (m *cache) dropDir(dir string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.dirs[cacheKey(dir)] = nil, false
+}
+
+// changed drops everything cached about p, anything below it, and the
+// listing of the directory holding it, after the client has added,
+// removed or moved p.
+func (m *cache) changed(p string) {
+	key := cacheKey(p)
+	parent, _ := path.Split(key)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.dirs[cacheKey(parent)] = nil, false
+	for name := range m.files {
+		if name == key || strings.HasPrefix(name, key+"/") {
+			m.files[name] = nil, false
+		}
+	}
+	for name := range m.dirs {
+		if name == key || strings.HasPrefix(name, key+"/") {
+			m.dirs[name] = nil, false
+		}
+	}
+}
+
+// clear drops everything, as when the client starts acting for someone
+// else, who may not see what the last identity could.
+func (m *cache) clear() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.files = make(map[string](*cachedFile))
+	m.dirs = make(map[string](*cachedDir))
+}
+
+// validate asks the master for the current versions of files and dirs.
+func (c *Client) validate(files []string, dirs []string) ([]uint64, []uint64, os.Error) {
+
+	var args sfs.ValidateArgs
+	var returnVal sfs.ValidateReturn
+
+	args.Files = files
+	args.Dirs = dirs
+	args.Cred = c.cred()
+
+	err := c.callMaster("Master.Validate",&args,&returnVal)
+	if(err != nil){
+		log.Println("Error Calling Master(Validate):", err)
+		return nil, nil, err
+	}
+	if len(returnVal.Files) != len(files) || len(returnVal.Dirs) != len(dirs) {
+		return nil, nil, os.NewError("Master.Validate answered for the wrong names")
+	}
+
+	return returnVal.Files, returnVal.Dirs, nil
+}
+
+// refresh fetches the chunks of an open file afresh, bypassing the cache,
+// after its cached chunk servers have let a read down.
+func (c *Client) refresh(meta *file) os.Error {
+	c.cache.dropFile(meta.name)
+
+	fileInfo := new (sfs.OpenReturn)
+	fileArgs := new (sfs.OpenArgs)
+	fileArgs.Name = meta.name
+	fileArgs.Access = openAccess(O_RDONLY)
+	fileArgs.Cred = c.cred()
+	err := c.callMaster("Master.ReadOpen", &fileArgs,&fileInfo)
+	if(err != nil){
+		log.Println("Client: refresh fail ", err)
+		return err
+	}
+	c.cache.putOpen(meta.name, fileArgs.Access, fileInfo)
+
+	var size uint64
+	chunkInfo := new(vector.Vector)
+	for _, info := range fileInfo.Chunk {
+		chunkInfo.Push(info)
+		size += info.Size
+	}
+
+	meta.lock.Lock()
+	defer meta.lock.Unlock()
+
+	meta.chunkInfo = chunkInfo
+	if size > meta.size {
+		meta.size = size
+	}
+	return nil
+}
@@ -7,9 +7,11 @@ import (
 	"os"
 	"log"
 	"../include/sfs"
-	"math"
-	//	"time"
-	"crypto/sha256"
+	"time"
+	"strings"
+	"io"
+	"net"
+	"sync"
 )
 
 const(
@@ -19,669 +21,928 @@ const(
 	O_WRONLY = 2
 	O_RDWR = 3
 	O_CREATE = 4
+	O_LEASE_SHARED = 8 // hold a shared lease: nobody may change the file while open
+	O_LEASE_EXCL = 16  // hold an exclusive lease: only this descriptor may change it
 	SEEK_SET = 1
 	SEEK_CURR = 2
 	SEEK_END = 4
 )
 
-type nameAndPtr struct {
-	name  string
-	filePtr uint64
-	permissions int
+// fileLease is a lease the master granted on open, kept alive in the
+// background until the file is closed.
+type fileLease struct {
+	c    *Client
+	id   uint64
+	stop chan bool
+
+	lock sync.Mutex
+	lost bool
 }
 
 type file struct {
+	lock sync.Mutex // held across a write, and to look at the fields below
 	size uint64
 	chunkInfo *vector.Vector
 	name string
-}
-
-var master string
-var fd int
-var openFiles = map[string] (*file){}
-var openDescriptors = map[int] (*nameAndPtr){}
+	chunkSize uint64
 
-func Initialize(masterAddr string){
-	fd = 0
-	log.Println("Client: Master IP = ", masterAddr);
-	master = masterAddr
+	refs int // Files open on it, guarded by Client.lock
 }
 
-func dialServer(address string) (*rpc.Client, os.Error){
-	server,err := rpc.Dial("tcp", address)
-	if(err != nil){
-		log.Println("Client: Dial Error to", address, err.String())
-	}
-	return server,err
+// Client is one session with an SFS cluster: the masters it talks to, the
+// identity it acts for, and the files it has open. A process may have any
+// number of them, against the same cluster or different ones, and each
+// may be used from many goroutines at once.
+type Client struct {
+	lock        sync.Mutex // guards everything below
+	masters     []string
+	masterIndex int
+	identity    sfs.Cred
+	files       map[string](*file) // what is known of each open file
+	pool        *sfs.Pool
+	cache       *cache
+
+	fd          int
+	descriptors map[int](*File) // for the fd functions below
 }
 
-func Open(filename string , flag int ) (int){
-	log.Println("Client: opening ", filename)
-	client,err :=rpc.Dial("tcp", master + ":1338"); //IP needs to be changed to Master's IP
-	if err != nil{
-		log.Println("Client: Dial Error ", err);
-		return FAIL
-	}else{
-		defer client.Close()
-		_,openF :=  openFiles[filename]
-
-		if !openF {
-			fileInfo := new (sfs.OpenReturn)
-			fileArgs := new (sfs.OpenArgs)
-			fileArgs.Lock = false
-			fileArgs.Name = filename
-			if((flag & O_CREATE) == O_CREATE){
-				log.Println("Client: Permissions for New file!")
-				fileArgs.NewFile = true
-			} else {
-				fileArgs.NewFile = false
-			}
-			err := client.Call("Master.ReadOpen", &fileArgs,&fileInfo)
-			if(err != nil){
-				log.Println("Client: Open fail ", err)
-				return sfs.FAIL
-			}
-			if fileInfo.New && (flag & O_CREATE) == O_CREATE {
-				log.Println("Client: New file!")
-
-			}else if !fileInfo.New  && (flag & O_CREATE) != O_CREATE   {
-				log.Println("Client: Old file!")
-			}else {
-				return sfs.FAIL
-			}
-
-			fd++
-			var nextFile file
-			nextFile.size = 0
-			nextFile.name = filename
+// Options tunes a new Client. A nil *Options, or a zero field, takes the
+// default.
+type Options struct {
+	User   string   // the user to act for, $USER by default
+	Groups []string // the user's groups, primary first; by default one named after the user
+	Pool   *sfs.Pool // connections to masters and chunk servers, sfs.Conns by default
 
-			nextFile.chunkInfo = new(vector.Vector)
-			for i := 0 ; i < cap(fileInfo.Chunk); i ++ {
-				nextFile.chunkInfo.Push(fileInfo.Chunk[i])
-				nextFile.size +=fileInfo.Chunk[i].Size
-			}
-			openFiles[filename] = &nextFile
-			var d nameAndPtr
-			d.name = filename
-			d.filePtr = 0
-			d.permissions = flag
-			openDescriptors[fd] = &d
-		}else{
-
-			fileInfo := new (sfs.OpenReturn)
-			fileArgs := new (sfs.OpenArgs)
-			fileArgs.Lock = false
-			fileArgs.Name = filename
-			err := client.Call("Master.ReadOpen", &fileArgs,&fileInfo)
-			if(err != nil){
-				log.Println("Client: Open fail ", err)
-				return sfs.FAIL
-			}
-			var nextFile file
-			nextFile.size = 0
-			nextFile.name = filename
+	// how long, in ns, metadata from the master is trusted before being
+	// checked again; sfs.CACHE_TTL by default, and negative to cache nothing
+	CacheTTL int64
+}
 
-			nextFile.chunkInfo = new(vector.Vector)
-			for i := 0 ; i < cap(fileInfo.Chunk); i ++ {
-				nextFile.chunkInfo.Push(fileInfo.Chunk[i])
+// std is the client the package level functions use.
+var std = New(nil, nil)
+
+// New makes a client of the cluster run by masterAddrs, each of which may
+// itself be a comma separated list. Calls go to the first master that
+// answers as primary.
+func New(masterAddrs []string, options *Options) *Client {
+	c := new(Client)
+	c.files = make(map[string](*file))
+	c.descriptors = make(map[int](*File))
+	for _, addrs := range masterAddrs {
+		for _, addr := range strings.Split(addrs, ",", -1) {
+			if addr != "" {
+				c.masters = append(c.masters, addr)
 			}
-			nextFile.size = openFiles[filename].size
-			openFiles[filename] = &nextFile
-
-			fd++
-			var d nameAndPtr
-			d.name = filename
-			d.permissions = flag
-			d.filePtr = 0
-			openDescriptors[fd] = &d
 		}
-		return fd;
 	}
 
-	return sfs.FAIL
+	var opts Options
+	if options != nil {
+		opts = *options
+	}
+	if opts.User == "" {
+		opts.User = os.Getenv("USER")
+	}
+	if len(opts.Groups) == 0 {
+		opts.Groups = []string{opts.User}
+	}
+	if opts.Pool == nil {
+		opts.Pool = sfs.Conns
+	}
+	if opts.CacheTTL == 0 {
+		opts.CacheTTL = sfs.CACHE_TTL
+	}
+	c.pool = opts.Pool
+	c.cache = newCache(opts.CacheTTL)
+	c.SetIdentity(opts.User, opts.Groups...)
+
+	return c
 }
 
-/* read */
-func Read (fd int, size int) ([]byte, int ){
+// Initialize takes one or more master addresses, as New does, and sets up
+// the client the package level functions use. It returns that client too.
+// Call it once, before any of the package level functions.
+func Initialize(masterAddrs ...string) *Client {
+	std = New(masterAddrs, nil)
+	log.Println("Client: Master IPs = ", std.masters);
+	return std
+}
 
-	log.Println("Client: **********READ BEGIN***********");
-	nameAndPointer, present :=  openDescriptors[fd]
-	var entireRead []byte
+// SetIdentity sets the user, and the groups, this client acts for from
+// here on. The first group is the one new files and directories get.
+func (c *Client) SetIdentity(user string, groups ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	if !present {
-		log.Println("Client: fd does not exist");
-		return entireRead, sfs.FAIL
-	}
-
-	filename := nameAndPointer.name
-	filePtr := nameAndPointer.filePtr
-	fdFile, present := openFiles[filename]
-
-	if((nameAndPointer.permissions & O_RDONLY) != O_RDONLY){ //check if file was opened with Read permissions
-		log.Println("Client: Cannot read without read permissions")
-		return entireRead, FAIL
-	}
-
-	if (int(filePtr)+(size)) > int(fdFile.size) {
-		entireRead = make([]byte,(fdFile.size - filePtr))
-	}else {
-		entireRead = make([]byte,size)
-	}
-	if !present {
-		log.Println("Client: File not in open list!")
-		return entireRead, FAIL
-	}
-	index := 0
-	startIndex :=int( filePtr % sfs.CHUNK_SIZE)
-	endIndex := int(cap(entireRead) + startIndex)
-	if endIndex > int(fdFile.size) {
-		endIndex = int(fdFile.size)
-	}
-	endChunk := int(math.Ceil((float64(filePtr)+float64(size))/sfs.CHUNK_SIZE))
-	log.Println("Client: fileName ",fdFile.name)
-	log.Println("Client: size = ", size, "index = ", index,  "  startIndex = ", startIndex)
-	log.Println("Client: endIndex = ", endIndex, "endChunk = ", endChunk)
-	log.Println("Client: filestarting size = ",fdFile.size)
-	if endChunk >  int(math.Ceil(float64(fdFile.size)/float64(sfs.CHUNK_SIZE))) {
-		endChunk = int(math.Ceil(float64(fdFile.size)/float64(sfs.CHUNK_SIZE)))
-		log.Println("Client: file was smaller than read size")
-	}
-	var returned int
-	for i := int(filePtr/sfs.CHUNK_SIZE); i<endChunk; i++ {
-		chunkServerMirrors := fdFile.chunkInfo.At(i).(sfs.ChunkInfo).Servers
-
-		numChunkServers := len(chunkServerMirrors)
-		log.Printf("Client: numChunkServers %d \n", numChunkServers)
-		if (numChunkServers < 1) {
-			log.Println("Client: Dial Failed in Read")
-			return entireRead, sfs.FAIL
-		}
+	c.identity.User = user
+	c.identity.Groups = groups
+	c.cache.clear()
+}
 
-		returned, bytesRead := GetChunk(*fdFile, i)
+// cred is who the client acts for, to send along with a call.
+func (c *Client) cred() sfs.Cred {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-		hasher := sha256.New()
-		hasher.Write(bytesRead[:])
-		if(string(hasher.Sum()) != string(fdFile.chunkInfo.At(i).(sfs.ChunkInfo).Hash)){
-			//log.Printf("looks like your hash may be bit off matey...arrrrrr\n\texpected: %x got: %x\n", fdFile.chunkInfo.At(i).(sfs.ChunkInfo).Hash, hasher.Sum())
-		}
+	return c.identity
+}
 
-		if(returned == sfs.SUCCESS ){
-			for k:=0; k<sfs.CHUNK_SIZE ; k++{
-				if (index< endIndex && index>= startIndex ) {
-					entireRead[index-startIndex] = bytesRead[k]
-				}
-				index++
+// callMaster makes an RPC against the master that answered last. If that
+// one is down or only a standby, it fails over to the next in the list,
+// and the one that answers is tried first from then on. Failing over drops
+// everything cached, as the new primary may not have seen the last changes
+// the old one made.
+func (c *Client) callMaster(method string, args interface{}, reply interface{}) os.Error {
+	c.lock.Lock()
+	masters, index := c.masters, c.masterIndex
+	c.lock.Unlock()
+	first := index
+
+	if len(masters) == 0 {
+		return os.NewError("no master configured")
+	}
+
+	var err os.Error
+	for i := 0; i < len(masters); i++ {
+		addr := masters[index]
+
+		err = c.pool.Call(sfs.MasterAddr(addr), method, args, reply)
+		if err == nil || !masterDown(method, err) {
+			//remember who answered, for the next call
+			c.lock.Lock()
+			c.masterIndex = index
+			c.lock.Unlock()
+			if index != first {
+				c.cache.clear()
 			}
-		}else {
-			return entireRead, sfs.FAIL
+			return err
 		}
-	}
 
-	openDescriptors[fd].filePtr += uint64(size)
-	if openDescriptors[fd].filePtr > fdFile.size {
-		openDescriptors[fd].filePtr	=openFiles[filename].size
+		log.Println("Client: master", addr, "unavailable:", err)
+		index = (index + 1) % len(masters)
 	}
-//	printByteSlice(entireRead)
-	log.Println("Client: *********READ END*************");
-	return  entireRead, returned;
-}
 
-/* write */
-func Write (fd int, data []byte) (int){
-	log.Println("Client: *************WRITE BEGIN**********");
-
-	masterServ,masterErr  := rpc.Dial("tcp",master + ":1338")
-	if masterErr != nil {
-		log.Println("Client: dial fail: ", masterErr)
-		return FAIL
-	}
-	if masterServ == nil {
-		return FAIL
-	}
-
-	nameAndPointer, inMap :=  openDescriptors[fd]
-	if !inMap {
-		log.Println("Client: fd does not exist");
-		return sfs.FAIL
-	}
-	filename := nameAndPointer.name
-	filePtr := nameAndPointer.filePtr
+	return err
+}
 
-	fdFile, inMap := openFiles[filename]
-	if !inMap {
-		log.Println("Client: File not in open list!")
-		return FAIL
-	}
+// masterDown reports whether a call to method that failed with err should
+// go to the next master instead.
+func masterDown(method string, err os.Error) bool {
+	return err.String() == sfs.ERR_STANDBY || sfs.Retry(method, err)
+}
 
-	log.Println("Client: fileName ",fdFile.name)
-	log.Println("Client: filestarting size = ",fdFile.size)
-	if((nameAndPointer.permissions & O_WRONLY) != O_WRONLY){
-		log.Println("Client: Cannot write without write permissions")
-		return FAIL
+// statusError turns a failed status from the master into an error.
+func statusError(method string, status int) os.Error {
+	if status == sfs.SUCCESS {
+		return nil
 	}
+	return os.NewError(method + " failed")
+}
 
-	indexWithinChunk := int( filePtr)%int(sfs.CHUNK_SIZE)
-	chunkOffset := int(filePtr)/int(sfs.CHUNK_SIZE)
-	var toWrite sfs.Chunk
+// Open opens the file at filename with the O_ flags above, creating it
+// with O_CREATE. O_CREATE fails if the file exists already.
+func (c *Client) Open(filename string, flag int) (*File, os.Error) {
+	log.Println("Client: opening ", filename)
 
-	//special case if writing to middle of first chunk
-	if  (indexWithinChunk  > 0) && (filePtr <= fdFile.size) {
-		returned, bytesRead := GetChunk(*fdFile, chunkOffset)
-		if(returned == sfs.SUCCESS){
-			for i:= 0 ; i < indexWithinChunk ; i++ {
-				toWrite.Data[i] = bytesRead[i]
-			}
-		}else{
-			log.Println("Client: Dial Failed in GetChunk trying to get beginning of first chunk")
-			return FAIL
+	fileInfo := new (sfs.OpenReturn)
+	fileArgs := new (sfs.OpenArgs)
+	fileArgs.Lease = leaseMode(flag)
+	fileArgs.Name = filename
+	fileArgs.Access = openAccess(flag)
+	fileArgs.Cred = c.cred()
+	if((flag & O_CREATE) == O_CREATE){
+		log.Println("Client: Permissions for New file!")
+		fileArgs.NewFile = true
+	}
+
+	//creating a file or taking a lease has to go to the master
+	var cached *sfs.OpenReturn
+	ok := false
+	if !fileArgs.NewFile && fileArgs.Lease == sfs.LEASE_NONE {
+		cached, ok = c.cachedOpen(filename, fileArgs.Access)
+	}
+	if ok {
+		log.Println("Client: Open from cache ", filename)
+		fileInfo = cached
+	} else {
+		err := c.callMaster("Master.ReadOpen", &fileArgs,&fileInfo)
+		if(err != nil){
+			log.Println("Client: Open fail ", err)
+			return nil, err
 		}
+		if fileInfo.New {
+			c.cache.changed(filename)
+		}
+		c.cache.putOpen(filename, fileArgs.Access, fileInfo)
 	}
-	fileArgs := new (sfs.WriteArgs);
-	fileInfo := new (sfs.WriteReturn);
-	for i:=0 ; i < len(data) ; i++  {
-		toWrite.Data[int(indexWithinChunk)] = data[i]
-		indexWithinChunk++
-
-		if ((indexWithinChunk == sfs.CHUNK_SIZE || i == len(data)-1)){
-			//special case if write to middle of last chunk
-			if  i == len(data)-1  && fdFile.size > (filePtr+uint64(len(data))) && indexWithinChunk != sfs.CHUNK_SIZE {
-				returned, bytesRead := GetChunk(*fdFile, chunkOffset)
-				if(returned == sfs.SUCCESS){
-				//	log.Println("BEFORE", toWrite.Data)
-				//	log.Println("READ", bytesRead)
-					for i:= indexWithinChunk ; i < sfs.CHUNK_SIZE ; i++ {
-						toWrite.Data[i] = bytesRead[i]
-					}
-				//	log.Println("AFTER", toWrite.Data)
-				}else{
-					log.Println("Client: Dial Failed in GetChunk trying to get beginning of last chunk", fdFile.size, "ptr", filePtr, "idx", indexWithinChunk)
-					return FAIL
-				}
-
-			}
 
-			hasher := sha256.New()
-			hasher.Write(toWrite.Data[:])
-			if len(toWrite.Data) < sfs.CHUNK_SIZE {
-				hasher.Write(make([]byte,(sfs.CHUNK_SIZE-len(toWrite.Data))))
+	c.lock.Lock()
+	meta, openF := c.files[filename]
+	if !openF {
+		if fileInfo.New && (flag & O_CREATE) == O_CREATE {
+			log.Println("Client: New file!")
+		}else if !fileInfo.New  && (flag & O_CREATE) != O_CREATE   {
+			log.Println("Client: Old file!")
+		}else {
+			c.lock.Unlock()
+			if fileInfo.LeaseID != 0 {
+				c.releaseLease(filename, fileInfo.LeaseID)
 			}
+			return nil, os.NewError("file already exists")
+		}
 
-			returned, toPush, newChunk := AddChunks(fdFile.name, 1,hasher.Sum())
-			if(fdFile.chunkInfo.Len() <= chunkOffset) {
-				if returned == sfs.FAIL {
-					log.Println("AddChunk failed 1")
-					return sfs.FAIL
-				}
-				fdFile.chunkInfo.Push(toPush)
-				log.Println("Client: adding chunk x")
-			}else{
-				if returned == sfs.FAIL {
-					log.Println("AddChunk failed 1")
-					return sfs.FAIL
-				}
-				fdFile.chunkInfo.Set(chunkOffset, toPush )
-				log.Println("Client: adding chunk y")
-			}
-			log.Println("new chunk ? ", newChunk)
-			if(newChunk){
-
-				fileArgs.Info = fdFile.chunkInfo.At(chunkOffset).(sfs.ChunkInfo)
-				fileArgs.Data = toWrite
-				if(len(fdFile.chunkInfo.At(chunkOffset).(sfs.ChunkInfo).Servers)<1){
-					log.Println("fdFile.chunkInfo ", fdFile.chunkInfo)
-				}
-
-				servers := fdFile.chunkInfo.At(chunkOffset).(sfs.ChunkInfo).Servers;
-				numChunkServers := len(servers)
-				if (numChunkServers < 1) {
-					log.Println("Client: Dial Failed in Write")
-					return sfs.FAIL
-				}
-
-				log.Println("Client: numChunkServers ", numChunkServers);
-				for j:=0; j < (numChunkServers); j++ {
-					client,err  := rpc.Dial("tcp",servers[0].String())
-					if err != nil ||  client == nil{
-						log.Println("Client: Dial to chunk failed, returned bad client", err);
-						numServers := len(fileArgs.Info.Servers)
-
-
-
-						tmp := fileArgs.Info.Servers[0]
-						for n:=0 ; n<numServers-1; n++ {
-							fileArgs.Info.Servers[n] = fileArgs.Info.Servers[n+1]
-						}
-						fileArgs.Info.Servers[numServers-1] = tmp
-						if j == numChunkServers-1 {
-							return sfs.FAIL
-						}
-						continue
-					}
-
-					err = client.Call("Server.Write", &fileArgs,&fileInfo);
-					client.Close()
-					if err != nil{
-						log.Println("Client: Server.Write failed:", err);
-						/*
-						numServers := len(fileArgs.Info.Servers)
-						tmp := fileArgs.Info.Servers[numServers-1]
-						for n:=0 ; n<numServers -1 ; n++{
-							fileArgs.Info.Servers[n+1] = fileArgs.Info.Servers[n]
-						}
-						fileArgs.Info.Servers[0] = tmp
-						*/
-						if j == numChunkServers-1 {
-							return sfs.FAIL
-						}
-						continue
-					}
-					if(fileInfo.Status!=0){
-						log.Println("Client: Server.Write status non zero=",fileInfo.Status)
-						if j == numChunkServers-1 {
-							return sfs.FAIL
-						}
-						continue
-					}
-					log.Println("Client: Wrote chunk", fileArgs.Info.ChunkID)//, "with", fileArgs.Data)
-					break
-				}
-			}else{
-				fileArgs.Info = toPush
-			}
+		meta = new(file)
+		meta.name = filename
+		c.files[filename] = meta
+	}
+	meta.refs++
+	c.lock.Unlock()
+
+	var size uint64
+	chunkInfo := new(vector.Vector)
+	for i := 0 ; i < cap(fileInfo.Chunk); i ++ {
+		chunkInfo.Push(fileInfo.Chunk[i])
+		size +=fileInfo.Chunk[i].Size
+	}
+
+	meta.lock.Lock()
+	meta.chunkSize = layoutChunkSize(fileInfo)
+	meta.chunkInfo = chunkInfo
+	//every write is mapped before it returns, so the master is never behind
+	meta.size = size
+	meta.lock.Unlock()
+
+	f := new(File)
+	f.c = c
+	f.shared = meta
+	f.name = filename
+	f.flag = flag
+	f.lease = c.holdLease(fileInfo.LeaseID, fileInfo.LeaseDuration)
+	return f, nil
+}
 
-			// reply to master
-			fileInfo.Info.ChunkID = fileArgs.Info.ChunkID
-			fileInfo.Info.Hash = hasher.Sum()
-			fileInfo.Info.Size = uint64(((indexWithinChunk-1)%int(sfs.CHUNK_SIZE)) +1)
-			mapArgs := &sfs.MapChunkToFileArgs{fdFile.name, chunkOffset, fileInfo.Info}
-			var mapRet sfs.MapChunkToFileReturn
-
-			err := masterServ.Call("Master.MapChunkToFile", &mapArgs,&mapRet);
-			if err != nil{
-				log.Println("Client: Master.MapChunkToFile failed:", err);
-				return FAIL
-			}
+// Create makes a new file at filename and opens it for reading and
+// writing.
+func (c *Client) Create(filename string) (*File, os.Error) {
+	return c.Open(filename, O_RDWR|O_CREATE)
+}
 
-			chunkOffset++;
-			indexWithinChunk =0
-		}
-	}
-	if masterServ != nil {
-		masterServ.Close()
+func leaseMode(flag int) int {
+	if (flag & O_LEASE_EXCL) == O_LEASE_EXCL {
+		return sfs.LEASE_EXCLUSIVE
+	} else if (flag & O_LEASE_SHARED) == O_LEASE_SHARED {
+		return sfs.LEASE_SHARED
 	}
+	return sfs.LEASE_NONE
+}
 
-	if fileInfo.Status !=FAIL && (openDescriptors[fd].filePtr+uint64(len(data)) > openFiles[filename].size) {
-		openFiles[filename].size = openDescriptors[fd].filePtr + uint64(len(data))
+// openAccess turns open flags into the permission bits the master checks.
+func openAccess(flag int) uint64 {
+	var access uint64
+	if (flag & O_RDONLY) == O_RDONLY {
+		access |= 4
 	}
-	if openFiles[filename].size > fdFile.size {
-		openFiles[filename].size = fdFile.size
+	if (flag & O_WRONLY) == O_WRONLY {
+		access |= 2
 	}
-	openDescriptors[fd].filePtr += uint64(len(data))
-	if openDescriptors[fd].filePtr > fdFile.size {
-		openDescriptors[fd].filePtr = fdFile.size
+	return access
+}
+
+// holdLease starts renewing a lease returned by Master.ReadOpen. It
+// returns nil when no lease was granted.
+func (c *Client) holdLease(id uint64, duration int64) *fileLease {
+	if id == 0 {
+		return nil
 	}
-	log.Println("Client: file ending size ", openFiles[filename].size);
-	log.Println("Client: fileInfo.Status = ", fileInfo.Status);
-	log.Println("Client: ************WRITE END**************");
-	return fileInfo.Status
+
+	l := new(fileLease)
+	l.c = c
+	l.id = id
+	l.stop = make(chan bool, 1)
+	go l.renew(duration)
+
+	return l
 }
 
-func GetChunk(fdFile file,  chunkOffset int)(int, [sfs.CHUNK_SIZE]byte){
-	log.Println("Client: Getting Chunk", fdFile.chunkInfo.At(chunkOffset).(sfs.ChunkInfo).ChunkID)
-	fileArgsRead := new (sfs.ReadArgs)
-	fileInfoRead := new (sfs.ReadReturn)
-	fileArgsRead.Nice = 1 // try things nicely first
-	Servers := fdFile.chunkInfo.At(chunkOffset).(sfs.ChunkInfo).Servers
-	numServers := len(Servers)
-	for i:= 0 ; i < (numServers*2) ; i ++ {
-		if i >= numServers {
-			fileArgsRead.Nice = 0
-		}
-		client,err :=rpc.Dial("tcp",Servers[i%numServers].String())
-		if client == nil {
-			log.Println("Client: Dial Failed in GetChunk client == nil ")
-			if i != (numServers*2)-1 {
-				continue
-			} else {
-				log.Println("Client: missed continue in GetChunk ")
-				return sfs.FAIL, fileInfoRead.Data.Data
-			}
-		}
-		//defer client.Close()
-		if err != nil {
-			log.Println("Client: Dial Failed in GetChunk err != nil ", err)
-			if i != (numServers*2-1) {
-				continue
-			}else{
-				log.Println("Client: missed continue in GetChunk ")
-				return sfs.FAIL, fileInfoRead.Data.Data
-			}
+// renew extends the lease every third of its duration. Failed renewals are
+// retried until the lease would have run out, at which point it is lost
+// and writes through the file fail.
+func (l *fileLease) renew(duration int64) {
+	deadline := time.Nanoseconds() + duration
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-time.After(duration / 3):
 		}
 
-		fileArgsRead.ChunkID= fdFile.chunkInfo.At(chunkOffset).(sfs.ChunkInfo).ChunkID;
-		if fileArgsRead.ChunkID == 0 {
-			log.Println("Client: ChunkID = 0, Chunk ID should never be 0")
+		args := &sfs.RenewLeaseArgs{l.id}
+		var ret sfs.RenewLeaseReturn
+		err := l.c.callMaster("Master.RenewLease", args, &ret)
+		if err == nil && ret.Status == sfs.SUCCESS {
+			duration = ret.Duration
+			deadline = time.Nanoseconds() + duration
+			continue
 		}
 
-		err = client.Call("Server.Read", &fileArgsRead,&fileInfoRead);
-		client.Close();
-		if err!=nil{
-			log.Printf("Client: Server.Read failed: %s, on server %s\n", err.String(),Servers[i%numServers].String());
-			log.Printf("On try %d out of %d with %d# of servers\n",i,(numServers*2-1), numServers);
-			if i != (numServers*2-1) {
-				continue
-			}
-			return sfs.FAIL, fileInfoRead.Data.Data
+		log.Println("Client: unable to renew lease", l.id, err)
+		if time.Nanoseconds() >= deadline {
+			log.Println("Client: lease", l.id, "lost")
+			l.lock.Lock()
+			l.lost = true
+			l.lock.Unlock()
+			return
 		}
+	}
+}
 
-		if fileInfoRead.Status != sfs.SUCCESS {
-			log.Println("Client: Read failed with status", fileInfoRead.Status, "on server", Servers[i%numServers])
-			if i != (numServers*2-1) {
-				continue
-			}
-			return sfs.FAIL, fileInfoRead.Data.Data
-		}else{
-			break
-		}
+func (l *fileLease) isLost() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
 
-		log.Println("At end of function with status ", fileInfoRead.Status)
-	}
-	log.Println("Client: Read chunk", fileArgsRead.ChunkID)
-	return sfs.SUCCESS, fileInfoRead.Data.Data
+	return l.lost
+}
 
+func (l *fileLease) release(filename string) {
+	l.stop <- true
+	if !l.isLost() {
+		l.c.releaseLease(filename, l.id)
+	}
 }
 
-/* delete */
-func Delete(filename string) (int){
+func (c *Client) releaseLease(filename string, id uint64) {
+	args := &sfs.LockReleaseArgs{filename, id}
+	var ret sfs.LockReleaseReturn
+	err := c.callMaster("Master.ReleaseLock", args, &ret)
+	if err != nil {
+		log.Println("Client: ReleaseLock failed:", err)
+	}
+}
 
-	_ , present := openFiles[filename]
-	if (!present ){
-//		log.Println("Client: filename does not exist ", filename);
-//		return FAIL
-	}else{
-		var dummy file
-		openFiles[filename] = &dummy,false
+// layoutChunkSize is the chunk size the master picked for an open file.
+func layoutChunkSize(info *sfs.OpenReturn) uint64 {
+	if info.ChunkSize == 0 {
+		return sfs.CHUNK_SIZE
 	}
+	return info.ChunkSize
+}
 
+// Delete removes the file at filename.
+func (c *Client) Delete(filename string) os.Error {
 
-	client,err :=rpc.Dial("tcp", master + ":1338"); //IP needs to be changed to Master's IP
-	defer client.Close()
+	c.cache.changed(filename)
 
-	if err != nil{
-		log.Println("Client: Dial Error", err);
-		return FAIL
-	}else{
-		fileArgs := new (sfs.DeleteArgs)
-		fileInfo := new (sfs.DeleteReturn)
-		fileArgs.Name = filename
-		err := client.Call("Master.DeleteFile", &fileArgs,&fileInfo)
-		if(err != nil || !fileInfo.Status){
-			log.Println("Client: Delete fail ", fileInfo.Status, err)
-			return FAIL
-		}
+	c.lock.Lock()
+	c.files[filename] = nil, false
+	c.lock.Unlock()
+
+	fileArgs := new (sfs.DeleteArgs)
+	fileInfo := new (sfs.DeleteReturn)
+	fileArgs.Name = filename
+	fileArgs.Cred = c.cred()
+	err := c.callMaster("Master.DeleteFile", &fileArgs,&fileInfo)
+	if(err == nil && !fileInfo.Status){
+		err = os.NewError("Master.DeleteFile failed")
+	}
+	if(err != nil){
+		log.Println("Client: Delete fail ", fileInfo.Status, err)
+		return err
 	}
-	return WIN
+	return nil
 }
 
-func Close(fd int) (int){
-	n, inMap :=  openDescriptors[fd]
-	filename := n.name
-	if !inMap {
-		log.Println("Client: fd does not exist");
-		return FAIL
+// ReadDir lists the directory at path, subdirectories first with a
+// trailing slash.
+func (c *Client) ReadDir(path string) ([]string, os.Error){
+
+	if names, ok := c.cachedDir(path); ok {
+		return names, nil
 	}
-	_ , present := openFiles[filename]
-	if (!present ){
-		log.Println("Client: filename does not exist", filename);
-		return FAIL
+
+	readDirArgs := new (sfs.ReadDirArgs)
+	readDirRet := new (sfs.ReadDirReturn)
+	readDirArgs.Prefix = path
+	readDirArgs.Cred = c.cred()
+	err := c.callMaster("Master.ReadDir", &readDirArgs, &readDirRet)
+	if(err != nil){
+		log.Println("Client: Read Dir fail ", err )
+		return readDirRet.FileNames, err
 	}
-	var dummy nameAndPtr
-	openDescriptors[fd]= &dummy,false
-	return WIN
+	c.cache.putDir(path, readDirRet.FileNames, readDirRet.Version)
+	return readDirRet.FileNames, nil
 }
 
-func ReadDir(path string) ([]string, int){
+// ReadDirAttrs is ReadDir with each entry's attributes, for ls -l.
+func (c *Client) ReadDirAttrs(path string) ([]sfs.FileAttr, os.Error){
 
 	readDirArgs := new (sfs.ReadDirArgs)
 	readDirRet := new (sfs.ReadDirReturn)
 	readDirArgs.Prefix = path
-	client,err :=rpc.Dial("tcp", master + ":1338"); //IP needs to be changed to Master's IP
-	defer client.Close()
-	if err != nil{
-		log.Println("Client: Dial Error", err);
-		return readDirRet.FileNames,  FAIL
-	}else{
-		err = client.Call("Master.ReadDir", &readDirArgs, &readDirRet)
-		if(err != nil){
-			log.Println("Client: Read Dir fail ", err )
-			return readDirRet.FileNames,  FAIL
-		}
+	readDirArgs.Cred = c.cred()
+	readDirArgs.Attrs = true
+	err := c.callMaster("Master.ReadDir", &readDirArgs, &readDirRet)
+	if(err != nil){
+		log.Println("Client: Read Dir fail ", err )
+		return readDirRet.Entries, err
 	}
-//	for i:= 0 ; i < len(readDirRet.FileNames) ; i++ {
-//		log.Println("Client: Got back directory: ", readDirRet.FileNames[i])
-//	}
-	return readDirRet.FileNames,  WIN
+	return readDirRet.Entries, nil
 }
 
-/* seek */
-func Seek (fd int, offset int, whence int) (int){
-	n, inMap :=  openDescriptors[fd]
-	filename := n.name
-	log.Println("Client: filestarting size = ", openFiles[filename].size)
-	log.Println("Client: fileName ",openFiles[filename].name)
+// Stat returns the size, layout, owner, mode and times of the file or
+// directory at path without opening it.
+func (c *Client) Stat(path string) (sfs.FileAttr, os.Error) {
 
-	if !inMap {
-		log.Println("Client: fd does not exist");
-		return FAIL
-	}
-	_ , present := openFiles[filename]
-	if !present{
-		return FAIL
-	}
-	filePtr := int(openDescriptors[fd].filePtr)
-	if whence == SEEK_SET {
-		filePtr = 0 + offset
-	}else if whence == SEEK_CURR {
-		filePtr = filePtr + offset
-	}else if whence == SEEK_END {
-		filePtr = int(openFiles[filename].size) + offset
+	var args sfs.StatArgs
+	var returnVal sfs.StatReturn
+
+	args.Name = path
+	args.Cred = c.cred()
+
+	err := c.callMaster("Master.Stat",&args,&returnVal)
+	if(err != nil){
+		log.Println("Error Calling Master(Stat):", err)
+		return returnVal.Attr, err
 	}
-	openDescriptors[fd].filePtr = uint64(filePtr)
-	if filePtr > int(openFiles[filename].size) {
-		openDescriptors[fd].filePtr = openFiles[filename].size
+
+	return returnVal.Attr, statusError("Master.Stat", returnVal.Status)
+}
+
+// Chmod sets the permission bits of a file or directory. Only its owner
+// may.
+func (c *Client) Chmod(path string, mode uint64) os.Error {
+
+	var args sfs.ChmodArgs
+	var returnVal sfs.ChmodReturn
+
+	args.Name = path
+	args.Mode = mode
+	args.Cred = c.cred()
+
+	c.cache.changed(path)
+
+	err := c.callMaster("Master.Chmod",&args,&returnVal)
+	if(err != nil){
+		log.Println("Error Calling Master(Chmod):", err)
+		return err
 	}
-	if filePtr < 0 {
-		openDescriptors[fd].filePtr = 0
+
+	return statusError("Master.Chmod", returnVal.Status)
+}
+
+// Chown changes the owner and group of a file or directory; "" leaves
+// either as it is.
+func (c *Client) Chown(path string, owner string, group string) os.Error {
+
+	var args sfs.ChownArgs
+	var returnVal sfs.ChownReturn
+
+	args.Name = path
+	args.Owner = owner
+	args.Group = group
+	args.Cred = c.cred()
+
+	c.cache.changed(path)
+
+	err := c.callMaster("Master.Chown",&args,&returnVal)
+	if(err != nil){
+		log.Println("Error Calling Master(Chown):", err)
+		return err
 	}
-	return  int(openDescriptors[fd].filePtr);
+
+	return statusError("Master.Chown", returnVal.Status)
 }
 
-func printByteSlice(toPrint []byte){
-	log.Println("Client: bytes Read length = ", len(toPrint))
-	log.Println("Client: bytes Read:")
-	var st string
+// Quota reports the usage and limits of the directory dir or the user
+// user, or with neither of every quota set plus the caller's own usage.
+// With set, the superuser limits dir or user to maxBytes and maxFiles
+// first; 0 means no limit.
+func (c *Client) Quota(dir string, user string, set bool, maxBytes uint64, maxFiles uint64) ([]sfs.QuotaInfo, os.Error) {
+
+	var args sfs.QuotaArgs
+	var returnVal sfs.QuotaReturn
+
+	args.Dir = dir
+	args.User = user
+	args.Set = set
+	args.MaxBytes = maxBytes
+	args.MaxFiles = maxFiles
+	args.Cred = c.cred()
 
-	for i := 0; i < len(toPrint); i++{
-		st += string(toPrint[i])
+	err := c.callMaster("Master.Quota",&args,&returnVal)
+	if(err != nil){
+		log.Println("Error Calling Master(Quota):", err)
+		return nil, err
 	}
 
-	log.Println(st)
+	return returnVal.Quotas, statusError("Master.Quota", returnVal.Status)
 }
 
-func MakeDir(path string) (int) {
+// MakeDir creates the directory at path; its parent has to exist.
+func (c *Client) MakeDir(path string) os.Error {
 
 	var args sfs.MakeDirArgs
 	var returnVal sfs.MakeDirReturn
 
 	args.DirName = path
+	args.Cred = c.cred()
 
-	masterConn,err := rpc.Dial("tcp", master + ":1338")
-	defer masterConn.Close()
-	if(err != nil){
-		log.Println("Error Dialing Master(MakeDir):", err)
-		return sfs.FAIL
-	}
+	c.cache.changed(path)
 
-	err = masterConn.Call("Master.MakeDir",&args,&returnVal)
+	err := c.callMaster("Master.MakeDir",&args,&returnVal)
 	if(err != nil){
 		log.Println("Error Calling Master(MakeDir):", err)
-		return sfs.FAIL
+		return err
 	}
 
-	return returnVal.Status
+	return statusError("Master.MakeDir", returnVal.Status)
 
 }
 
-
-func RemoveDir(path string) (int) {
+// RemoveDir removes the directory at path. Unless recursive is set it has
+// to be empty; otherwise everything below it goes too.
+func (c *Client) RemoveDir(path string, recursive bool) os.Error {
 
 	var args sfs.RemoveDirArgs
 	var returnVal sfs.RemoveDirReturn
 
 	args.DirName = path
+	args.Cred = c.cred()
+	args.Recursive = recursive
 
-	masterConn,err := rpc.Dial("tcp", master + ":1338")
-	defer masterConn.Close()
+	c.cache.changed(path)
+
+	err := c.callMaster("Master.RemoveDir",&args,&returnVal)
 	if(err != nil){
-		log.Println("Error Dialing Master(Remove Dir):", err)
-		return sfs.FAIL
+		log.Println("Error Calling Master(RemoveDir):", err)
+		return err
 	}
 
-	err = masterConn.Call("Master.RemoveDir",&args,&returnVal)
+	return statusError("Master.RemoveDir", returnVal.Status)
+
+}
+
+// Rename moves the file or directory at from to to in one step. With
+// overwrite an existing file, or empty directory, at to is replaced;
+// otherwise the rename fails if to exists.
+func (c *Client) Rename(from string, to string, overwrite bool) os.Error {
+
+	var args sfs.RenameArgs
+	var returnVal sfs.RenameReturn
+
+	args.From = from
+	args.To = to
+	args.Overwrite = overwrite
+	args.Cred = c.cred()
+
+	c.cache.changed(from)
+	c.cache.changed(to)
+
+	err := c.callMaster("Master.Rename",&args,&returnVal)
 	if(err != nil){
-		log.Println("Error Calling Master(RemoveDir):", err)
-		return sfs.FAIL
+		log.Println("Error Calling Master(Rename):", err)
+		return err
 	}
 
-	return returnVal.Status
+	return statusError("Master.Rename", returnVal.Status)
 
 }
 
-func AddChunks(fileName string, numChunks uint64,hash []byte) (int, sfs.ChunkInfo,bool) {
+// addChunk asks the master for a chunk to hold data hashing to hash in
+// fileName. If the master already has one with that hash it hands that
+// back, and newChunk is false.
+func (c *Client) addChunk(fileName string, hash []byte) (info sfs.ChunkInfo, newChunk bool, err os.Error) {
 
 	var args sfs.GetNewChunkArgs
 	var returnVal sfs.GetNewChunkReturn
 
 	args.Name = fileName
-	args.Count = numChunks
+	args.Count = 1
 	args.Hash =  hash
 
 //	log.Printf("AddChunks: getting chunk for file %s with hash %x\n", fileName, args.Hash)
 
-	masterConn,err := rpc.Dial("tcp", master + ":1338")
+	err = c.callMaster("Master.GetNewChunk",&args,&returnVal)
+	if(err != nil){
+		log.Println("Error Calling Master(AddChunks):", err)
+	}
+	return returnVal.Info, returnVal.NewChunk, err
+
+}
 
+// ReportBadChunk tells the master that server holds a corrupt copy of a
+// chunk so it can be replaced from a good one.
+func (c *Client) ReportBadChunk(chunkID uint64, server net.TCPAddr) os.Error {
+
+	var args sfs.ReportBadChunkArgs
+	var returnVal sfs.ReportBadChunkReturn
+
+	args.ChunkID = chunkID
+	args.Server = server
+
+	err := c.callMaster("Master.ReportBadChunk",&args,&returnVal)
 	if(err != nil){
-		log.Println("Error Dialing Master(AddChunks):", err)
-		return sfs.FAIL, returnVal.Info, returnVal.NewChunk
+		log.Println("Error Calling Master(ReportBadChunk):", err)
+		return err
 	}
 
-	err = masterConn.Call("Master.GetNewChunk",&args,&returnVal)
+	return statusError("Master.ReportBadChunk", returnVal.Status)
+}
+
+// SetLayout overrides the chunk size and replication factor of a file or
+// directory. Zero leaves a setting as it is. A file's chunk size can only
+// change while it is still empty.
+func (c *Client) SetLayout(path string, chunkSize uint64, replicas int) os.Error {
+
+	var args sfs.SetLayoutArgs
+	var returnVal sfs.SetLayoutReturn
+
+	args.Name = path
+	args.ChunkSize = chunkSize
+	args.Replicas = replicas
+	args.Cred = c.cred()
+
+	c.cache.changed(path)
+
+	err := c.callMaster("Master.SetLayout",&args,&returnVal)
 	if(err != nil){
-		log.Println("Error Calling Master(AddChunks):", err)
-		return sfs.FAIL, returnVal.Info, returnVal.NewChunk
+		log.Println("Error Calling Master(SetLayout):", err)
+		return err
 	}
-	masterConn.Close()
-	return sfs.SUCCESS, returnVal.Info, returnVal.NewChunk
 
+	return statusError("Master.SetLayout", returnVal.Status)
 }
 
+// Rebalance starts or stops the master's rebalancer, which moves chunks
+// from the fullest chunk servers to the emptiest at no more than budget
+// bytes a second. With neither start nor stop it only reports progress.
+func (c *Client) Rebalance(start bool, stop bool, budget int64, threshold float64) (sfs.RebalanceReturn, os.Error) {
+
+	var args sfs.RebalanceArgs
+	var returnVal sfs.RebalanceReturn
+
+	args.Start = start
+	args.Stop = stop
+	args.Budget = budget
+	args.Threshold = threshold
+	args.Cred = c.cred()
+
+	err := c.callMaster("Master.Rebalance",&args,&returnVal)
+	if(err != nil){
+		log.Println("Error Calling Master(Rebalance):", err)
+		return returnVal, err
+	}
+
+	return returnVal, statusError("Master.Rebalance", returnVal.Status)
+}
+
+// DrainServer starts decommissioning the chunk server at addr, or with
+// cancel returns it to service, and reports how far draining has got.
+func (c *Client) DrainServer(addr string, cancel bool) (sfs.DrainServerReturn, os.Error) {
+
+	var args sfs.DrainServerArgs
+	var returnVal sfs.DrainServerReturn
+
+	server, err := net.ResolveTCPAddr(addr)
+	if(err != nil){
+		log.Println("Error Resolving Chunk Server(DrainServer):", err)
+		return returnVal, err
+	}
+
+	args.Server = *server
+	args.Cancel = cancel
+	args.Cred = c.cred()
+
+	err = c.callMaster("Master.DrainServer",&args,&returnVal)
+	if(err != nil){
+		log.Println("Error Calling Master(DrainServer):", err)
+		return returnVal, err
+	}
+
+	return returnVal, statusError("Master.DrainServer", returnVal.Status)
+}
+
+// Promote asks the standby master at masterAddr to take over as primary.
+func Promote(masterAddr string, force bool) (int) {
+
+	var args sfs.PromoteArgs
+	var returnVal sfs.PromoteReturn
+
+	args.Force = force
+	args.Cred = std.cred()
+
+	masterConn,err := rpc.Dial("tcp", sfs.MasterAddr(masterAddr))
+	if(err != nil){
+		log.Println("Error Dialing Master(Promote):", err)
+		return sfs.FAIL
+	}
+	defer masterConn.Close()
+
+	err = masterConn.Call("Master.Promote",&args,&returnVal)
+	if(err != nil){
+		log.Println("Error Calling Master(Promote):", err)
+		return sfs.FAIL
+	}
+
+	return returnVal.Status
+}
+
+/*
+ * The functions below are the original interface: integer descriptors
+ * and status codes, against the client Initialize set up. They are thin
+ * wrappers over Client and File.
+ */
+
+// status turns an error into a return code, keeping running out of quota
+// apart from everything else.
+func status(err os.Error) int {
+	if err == nil {
+		return WIN
+	}
+	if err.String() == sfs.ERR_QUOTA {
+		return sfs.QUOTA_EXCEEDED
+	}
+	return sfs.FAIL
+}
+
+// SetIdentity sets the identity of the client Initialize set up.
+// Initialize defaults to $USER, in a group of the same name.
+func SetIdentity(user string, groups ...string) {
+	std.SetIdentity(user, groups...)
+}
+
+// descriptor finds the File behind fd.
+func (c *Client) descriptor(fd int) (*File, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	f, inMap := c.descriptors[fd]
+	if !inMap {
+		log.Println("Client: fd does not exist");
+	}
+	return f, inMap
+}
+
+func Open(filename string , flag int ) (int){
+	f, err := std.Open(filename, flag)
+	if err != nil {
+		return status(err)
+	}
+
+	std.lock.Lock()
+	defer std.lock.Unlock()
+
+	std.fd++
+	std.descriptors[std.fd] = f
+	return std.fd
+}
+
+/* read */
+func Read (fd int, size int) ([]byte, int ){
+	f, inMap := std.descriptor(fd)
+	if !inMap {
+		return nil, sfs.FAIL
+	}
+
+	buf := make([]byte, size)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != os.EOF && err != io.ErrUnexpectedEOF {
+		return buf[:n], status(err)
+	}
+	return buf[:n], sfs.SUCCESS
+}
+
+/* write */
+func Write (fd int, data []byte) (int){
+	f, inMap := std.descriptor(fd)
+	if !inMap {
+		return sfs.FAIL
+	}
+
+	_, err := f.Write(data)
+	return status(err)
+}
+
+// GetChunk fetches length bytes starting at offset within the chunk at
+// chunkOffset in f; a length of 0 reads to the end of the chunk.
+func GetChunk(f *File,  chunkOffset int, offset uint64, length uint64)(int, []byte){
+	meta, err := f.meta()
+	if err != nil {
+		return FAIL, nil
+	}
+
+	meta.lock.Lock()
+	if chunkOffset < 0 || chunkOffset >= meta.chunkInfo.Len() {
+		meta.lock.Unlock()
+		return FAIL, nil
+	}
+	info := meta.chunkInfo.At(chunkOffset).(sfs.ChunkInfo)
+	meta.lock.Unlock()
+
+	data, err := f.c.getChunk(info, offset, length)
+	return status(err), data
+}
+
+/* delete */
+func Delete(filename string) (int){
+	return status(std.Delete(filename))
+}
+
+func Close(fd int) (int){
+	f, inMap := std.descriptor(fd)
+	if !inMap {
+		return FAIL
+	}
+	std.lock.Lock()
+	std.descriptors[fd] = nil, false
+	std.lock.Unlock()
+	return status(f.Close())
+}
+
+/* seek */
+func Seek (fd int, offset int, whence int) (int){
+	f, inMap := std.descriptor(fd)
+	if !inMap {
+		return FAIL
+	}
+
+	var w int
+	switch whence {
+	case SEEK_SET:
+		w = 0
+	case SEEK_CURR:
+		w = 1
+	case SEEK_END:
+		w = 2
+	}
+	ptr, err := f.Seek(int64(offset), w)
+	if err == ErrNegative {
+		ptr, err = f.Seek(0, 0)
+	}
+	if err != nil {
+		return FAIL
+	}
+	return int(ptr)
+}
+
+func ReadDir(path string) ([]string, int){
+	names, err := std.ReadDir(path)
+	return names, status(err)
+}
+
+func ReadDirAttrs(path string) ([]sfs.FileAttr, int){
+	entries, err := std.ReadDirAttrs(path)
+	return entries, status(err)
+}
+
+func Stat(path string) (sfs.FileAttr, int) {
+	attr, err := std.Stat(path)
+	return attr, status(err)
+}
+
+func Chmod(path string, mode uint64) (int) {
+	return status(std.Chmod(path, mode))
+}
+
+func Chown(path string, owner string, group string) (int) {
+	return status(std.Chown(path, owner, group))
+}
+
+func Quota(dir string, user string, set bool, maxBytes uint64, maxFiles uint64) ([]sfs.QuotaInfo, int) {
+	quotas, err := std.Quota(dir, user, set, maxBytes, maxFiles)
+	return quotas, status(err)
+}
+
+func MakeDir(path string) (int) {
+	return status(std.MakeDir(path))
+}
+
+func RemoveDir(path string, recursive bool) (int) {
+	return status(std.RemoveDir(path, recursive))
+}
+
+func Rename(from string, to string, overwrite bool) (int) {
+	return status(std.Rename(from, to, overwrite))
+}
+
+func AddChunks(fileName string, numChunks uint64,hash []byte) (int, sfs.ChunkInfo,bool) {
+	info, newChunk, err := std.addChunk(fileName, hash)
+	return status(err), info, newChunk
+}
+
+func ReportBadChunk(chunkID uint64, server net.TCPAddr) (int) {
+	return status(std.ReportBadChunk(chunkID, server))
+}
+
+func SetLayout(path string, chunkSize uint64, replicas int) (int) {
+	return status(std.SetLayout(path, chunkSize, replicas))
+}
+
+func Rebalance(start bool, stop bool, budget int64, threshold float64) (sfs.RebalanceReturn, int) {
+	ret, err := std.Rebalance(start, stop, budget, threshold)
+	return ret, status(err)
+}
+
+func DrainServer(addr string, cancel bool) (sfs.DrainServerReturn, int) {
+	ret, err := std.DrainServer(addr, cancel)
+	return ret, status(err)
+}
@@ -0,0 +1,512 @@
+package client
+
+import (
+	"io"
+	"os"
+	"log"
+	"net"
+	"sync"
+	"crypto/sha256"
+	"../include/sfs"
+)
+
+// File is an open SFS file. It satisfies io.Reader, io.Writer, io.Seeker,
+// io.ReaderAt, io.WriterAt and io.Closer, so it can be handed to io.Copy,
+// bufio and the rest of the standard library. Several Files, through one
+// Client, may have the same file open; they share what is known of its
+// chunks and size but each has its own offset. A File may be used from
+// several goroutines, though Read, Write and Seek, which move the offset,
+// then go one at a time; ReadAt and WriteAt don't need to.
+type File struct {
+	c      *Client
+	shared *file // what it has in common with other Files on the same file
+	name   string
+	flag   int
+	lease  *fileLease
+
+	lock sync.Mutex
+	ptr  uint64 // offset of the next Read or Write
+
+	closed bool // guarded by c.lock
+}
+
+var ErrClosed = os.NewError("file already closed")
+var ErrNotOpen = os.NewError("file not in open list")
+var ErrNoRead = os.NewError("file not opened for reading")
+var ErrNoWrite = os.NewError("file not opened for writing")
+var ErrLeaseLost = os.NewError("lease on file lost")
+var ErrNoServers = os.NewError("no chunk servers for chunk")
+var ErrBadWhence = os.NewError("bad whence")
+var ErrNegative = os.NewError("negative offset")
+var ErrHole = os.NewError("write would leave a hole in the file")
+
+// Name returns the path the file was opened with.
+func (f *File) Name() string {
+	return f.name
+}
+
+// Size returns the length of the file as this client knows it.
+func (f *File) Size() int64 {
+	meta, err := f.meta()
+	if err != nil {
+		return 0
+	}
+
+	meta.lock.Lock()
+	defer meta.lock.Unlock()
+
+	return int64(meta.size)
+}
+
+// meta returns the shared state of the file, checking it is still open.
+func (f *File) meta() (*file, os.Error) {
+	f.c.lock.Lock()
+	defer f.c.lock.Unlock()
+
+	if f.closed {
+		return nil, ErrClosed
+	}
+	meta, ok := f.c.files[f.name]
+	if !ok {
+		return nil, ErrNotOpen
+	}
+	return meta, nil
+}
+
+// Read reads up to len(p) bytes from the current offset and moves past
+// them. At the end of the file it returns 0, os.EOF.
+func (f *File) Read(p []byte) (int, os.Error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	n, err := f.ReadAt(p, int64(f.ptr))
+	f.ptr += uint64(n)
+	if err == os.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt reads len(p) bytes starting at off, without touching the offset.
+// Fewer bytes come back only with an error, os.EOF if the file ends first.
+func (f *File) ReadAt(p []byte, off int64) (int, os.Error) {
+	log.Println("Client: **********READ BEGIN***********")
+
+	meta, err := f.meta()
+	if err != nil {
+		return 0, err
+	}
+	if (f.flag & O_RDONLY) != O_RDONLY {
+		log.Println("Client: Cannot read without read permissions")
+		return 0, ErrNoRead
+	}
+	if off < 0 {
+		return 0, ErrNegative
+	}
+
+	//note the chunks the read covers, then fetch them without the lock
+	meta.lock.Lock()
+	start := uint64(off)
+	if start >= meta.size {
+		meta.lock.Unlock()
+		return 0, os.EOF
+	}
+	want := p
+	if start+uint64(len(p)) > meta.size {
+		want = p[:meta.size-start]
+	}
+	readEnd := start + uint64(len(want))
+
+	chunkSize := meta.chunkSize
+	first := int(start / chunkSize)
+	var infos []sfs.ChunkInfo
+	for i := first; uint64(i)*chunkSize < readEnd; i++ {
+		if i >= meta.chunkInfo.Len() {
+			//the size ran ahead of the chunks we know of; stop at them
+			readEnd = uint64(i) * chunkSize
+			break
+		}
+		infos = append(infos, meta.chunkInfo.At(i).(sfs.ChunkInfo))
+	}
+	meta.lock.Unlock()
+	if readEnd <= start {
+		return 0, os.EOF
+	}
+	want = want[:readEnd-start]
+
+	log.Println("Client: fileName ", meta.name)
+	log.Println("Client: size = ", len(p), "offset = ", start, "readEnd = ", readEnd)
+
+	for i := first; uint64(i)*chunkSize < readEnd; i++ {
+		//only fetch the part of this chunk the read covers
+		chunkStart := uint64(i) * chunkSize
+		lo := chunkStart
+		if lo < start {
+			lo = start
+		}
+		hi := chunkStart + chunkSize
+		if hi > readEnd {
+			hi = readEnd
+		}
+
+		data, err := f.c.getChunk(infos[i-first], lo-chunkStart, hi-lo)
+		if err != nil && f.c.refresh(meta) == nil {
+			//the servers may have moved since the chunks were looked up
+			meta.lock.Lock()
+			if i < meta.chunkInfo.Len() {
+				infos[i-first] = meta.chunkInfo.At(i).(sfs.ChunkInfo)
+			}
+			meta.lock.Unlock()
+			data, err = f.c.getChunk(infos[i-first], lo-chunkStart, hi-lo)
+		}
+		if err != nil {
+			return int(lo - start), err
+		}
+
+		n := copy(want[lo-start:hi-start], data)
+		if uint64(n) < hi-lo {
+			//the server had less of the chunk than the master said
+			return int(lo-start) + n, io.ErrUnexpectedEOF
+		}
+	}
+
+	log.Println("Client: *********READ END*************")
+	if len(want) < len(p) {
+		return len(want), os.EOF
+	}
+	return len(want), nil
+}
+
+// Write writes p at the current offset and moves past it.
+func (f *File) Write(p []byte) (int, os.Error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	n, err := f.WriteAt(p, int64(f.ptr))
+	f.ptr += uint64(n)
+	return n, err
+}
+
+// WriteAt writes p starting at off, without touching the offset. Files
+// have no holes, so off can be no further than the end of the file; past
+// it WriteAt fails with ErrHole.
+func (f *File) WriteAt(p []byte, off int64) (int, os.Error) {
+	log.Println("Client: *************WRITE BEGIN**********")
+
+	meta, err := f.meta()
+	if err != nil {
+		return 0, err
+	}
+
+	log.Println("Client: fileName ", meta.name)
+	log.Println("Client: filestarting size = ", meta.size)
+	if (f.flag & O_WRONLY) != O_WRONLY {
+		log.Println("Client: Cannot write without write permissions")
+		return 0, ErrNoWrite
+	}
+	if off < 0 {
+		return 0, ErrNegative
+	}
+
+	//one write at a time to a file: each rewrites whole chunks
+	meta.lock.Lock()
+	defer meta.lock.Unlock()
+
+	if uint64(off) > meta.size {
+		return 0, ErrHole
+	}
+	var leaseID uint64
+	if f.lease != nil {
+		if f.lease.isLost() {
+			log.Println("Client: Cannot write after losing the lease")
+			return 0, ErrLeaseLost
+		}
+		leaseID = f.lease.id
+	}
+
+	start := uint64(off)
+	chunkSize := int(meta.chunkSize)
+	indexWithinChunk := int(start) % chunkSize
+	chunkOffset := int(start) / chunkSize
+	toWrite := make([]byte, chunkSize)
+	written := 0
+
+	//special case if writing to middle of first chunk
+	if indexWithinChunk > 0 {
+		data, err := f.c.getChunk(meta.chunkInfo.At(chunkOffset).(sfs.ChunkInfo), 0, uint64(indexWithinChunk))
+		if err != nil {
+			log.Println("Client: Dial Failed in GetChunk trying to get beginning of first chunk")
+			return 0, err
+		}
+		copy(toWrite[0:indexWithinChunk], data)
+	}
+
+	for i := 0; i < len(p); i++ {
+		toWrite[indexWithinChunk] = p[i]
+		indexWithinChunk++
+
+		if indexWithinChunk != chunkSize && i != len(p)-1 {
+			continue
+		}
+		chunkLen := indexWithinChunk
+
+		//special case if write to middle of last chunk
+		if i == len(p)-1 && meta.size > start+uint64(len(p)) && indexWithinChunk != chunkSize {
+			data, err := f.c.getChunk(meta.chunkInfo.At(chunkOffset).(sfs.ChunkInfo), uint64(indexWithinChunk), 0)
+			if err != nil {
+				log.Println("Client: Dial Failed in GetChunk trying to get beginning of last chunk", meta.size, "off", start, "idx", indexWithinChunk)
+				return f.wrote(meta, start, written, err)
+			}
+			chunkLen += copy(toWrite[indexWithinChunk:], data)
+		}
+
+		info, err := f.c.writeChunk(meta, chunkOffset, toWrite[0:chunkLen], leaseID)
+		if err != nil {
+			return f.wrote(meta, start, written, err)
+		}
+		log.Println("Client: Wrote chunk", info.ChunkID)
+
+		written = i + 1
+		chunkOffset++
+		indexWithinChunk = 0
+	}
+
+	log.Println("Client: ************WRITE END**************")
+	return f.wrote(meta, start, written, nil)
+}
+
+// wrote grows the file to cover n bytes written at start and returns n and
+// err, for WriteAt to return. The caller holds meta.lock.
+func (f *File) wrote(meta *file, start uint64, n int, err os.Error) (int, os.Error) {
+	if start+uint64(n) > meta.size {
+		meta.size = start + uint64(n)
+	}
+	log.Println("Client: file ending size ", meta.size)
+	return n, err
+}
+
+// Seek sets the offset for the next Read or Write: relative to the start
+// of the file for whence 0, the current offset for 1 and the end for 2.
+// Files have no holes, so seeking past the end stops at the end.
+func (f *File) Seek(offset int64, whence int) (int64, os.Error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	size := f.Size()
+	if _, err := f.meta(); err != nil {
+		return 0, err
+	}
+
+	var ptr int64
+	switch whence {
+	case 0:
+		ptr = offset
+	case 1:
+		ptr = int64(f.ptr) + offset
+	case 2:
+		ptr = size + offset
+	default:
+		return int64(f.ptr), ErrBadWhence
+	}
+
+	if ptr < 0 {
+		return int64(f.ptr), ErrNegative
+	}
+	if ptr > size {
+		ptr = size
+	}
+	f.ptr = uint64(ptr)
+	return ptr, nil
+}
+
+// Close lets go of the file, and of any lease held on it.
+func (f *File) Close() os.Error {
+	if _, err := f.meta(); err != nil {
+		log.Println("Client: close:", f.name, err)
+		return err
+	}
+
+	f.c.lock.Lock()
+	closed := f.closed
+	f.closed = true
+	if !closed {
+		//the last File on it takes the shared state with it
+		f.shared.refs--
+		if f.shared.refs == 0 && f.c.files[f.name] == f.shared {
+			f.c.files[f.name] = nil, false
+		}
+	}
+	f.c.lock.Unlock()
+
+	if closed {
+		return ErrClosed
+	}
+	if f.lease != nil {
+		f.lease.release(f.name)
+	}
+	return nil
+}
+
+// writeChunk stores data as the chunk at chunkOffset in the file, on new
+// chunk servers unless the master already has a chunk with the same
+// contents, and maps it into the file. The caller holds meta.lock.
+func (c *Client) writeChunk(meta *file, chunkOffset int, data []byte, leaseID uint64) (sfs.ChunkInfo, os.Error) {
+	hasher := sha256.New()
+	hasher.Write(data)
+
+	info, newChunk, err := c.addChunk(meta.name, hasher.Sum())
+	if err != nil {
+		log.Println("AddChunk failed 1")
+		return info, err
+	}
+	log.Println("new chunk ? ", newChunk)
+
+	// reply to master, with the servers that took the data if it is new
+	var mapped sfs.ChunkInfo
+	if newChunk {
+		mapped.Servers, err = c.storeChunk(info, data)
+		if err != nil {
+			return info, err
+		}
+	}
+	mapped.ChunkID = info.ChunkID
+	mapped.Hash = hasher.Sum()
+	mapped.Size = uint64(len(data))
+	mapped.Version = info.Version
+	mapArgs := &sfs.MapChunkToFileArgs{meta.name, chunkOffset, mapped, leaseID, c.cred()}
+	var mapRet sfs.MapChunkToFileReturn
+
+	//the cached chunk list is out of date now, mapped or not
+	c.cache.dropFile(meta.name)
+
+	err = c.callMaster("Master.MapChunkToFile", &mapArgs, &mapRet)
+	if err != nil {
+		log.Println("Client: Master.MapChunkToFile failed:", err)
+		return info, err
+	}
+
+	//only now is the chunk part of the file, on the servers that took it
+	if !newChunk {
+		mapped.Servers = info.Servers
+	}
+	if meta.chunkInfo.Len() <= chunkOffset {
+		meta.chunkInfo.Push(mapped)
+	} else {
+		meta.chunkInfo.Set(chunkOffset, mapped)
+	}
+	return mapped, nil
+}
+
+// storeChunk writes data to the first of info's chunk servers that takes
+// it; that server passes it along to the others. It returns the servers
+// that ended up with a copy.
+func (c *Client) storeChunk(info sfs.ChunkInfo, data []byte) ([]net.TCPAddr, os.Error) {
+	args := new(sfs.WriteArgs)
+	ret := new(sfs.WriteReturn)
+	args.Info = info
+	args.Data.Data = data
+
+	numChunkServers := len(args.Info.Servers)
+	if numChunkServers < 1 {
+		log.Println("Client: Dial Failed in Write")
+		return nil, ErrNoServers
+	}
+
+	log.Println("Client: numChunkServers ", numChunkServers)
+	var err os.Error
+	for j := 0; j < numChunkServers; j++ {
+		err = c.pool.Call(args.Info.Servers[0].String(), "Server.Write", &args, &ret)
+		if err != nil && sfs.Broken(err) {
+			log.Println("Client: Dial to chunk failed, returned bad client", err)
+
+			//try the next server at the head of the chain
+			tmp := args.Info.Servers[0]
+			for n := 0; n < numChunkServers-1; n++ {
+				args.Info.Servers[n] = args.Info.Servers[n+1]
+			}
+			args.Info.Servers[numChunkServers-1] = tmp
+			continue
+		}
+		if err != nil {
+			log.Println("Client: Server.Write failed:", err)
+			continue
+		}
+		if ret.Status != 0 {
+			log.Println("Client: Server.Write status non zero=", ret.Status)
+			err = os.NewError("chunk server refused the write")
+			continue
+		}
+		return ret.Info.Servers, nil
+	}
+	return nil, err
+}
+
+// getChunk fetches length bytes starting at offset within the chunk info;
+// a length of 0 reads to the end of the chunk. The chunk server checks the
+// whole chunk against its hash before serving any of it and fails the
+// read if it doesn't match, so another replica is tried. Whole chunk
+// fetches are checked here too, which catches damage on the way, and a
+// replica that fails that check is reported to the master and skipped.
+func (c *Client) getChunk(info sfs.ChunkInfo, offset uint64, length uint64) ([]byte, os.Error) {
+	log.Println("Client: Getting Chunk", info.ChunkID)
+	fileArgsRead := new(sfs.ReadArgs)
+	fileInfoRead := new(sfs.ReadReturn)
+	fileArgsRead.Nice = 1 // try things nicely first
+	fileArgsRead.Offset = offset
+	fileArgsRead.Length = length
+	Servers := info.Servers
+	numServers := len(Servers)
+	if numServers < 1 {
+		log.Println("Client: Dial Failed in Read")
+		return nil, ErrNoServers
+	}
+	corrupt := make(map[int]bool)
+	var err os.Error
+	for i := 0; i < (numServers * 2); i++ {
+		if i >= numServers {
+			fileArgsRead.Nice = 0
+		}
+		if corrupt[i%numServers] {
+			continue
+		}
+		fileArgsRead.ChunkID = info.ChunkID
+		if fileArgsRead.ChunkID == 0 {
+			log.Println("Client: ChunkID = 0, Chunk ID should never be 0")
+		}
+
+		err = c.pool.Call(Servers[i%numServers].String(), "Server.Read", &fileArgsRead, &fileInfoRead)
+		if err != nil {
+			log.Printf("Client: Server.Read failed: %s, on server %s\n", err.String(), Servers[i%numServers].String())
+			log.Printf("On try %d out of %d with %d# of servers\n", i, (numServers*2 - 1), numServers)
+			continue
+		}
+
+		if fileInfoRead.Status != sfs.SUCCESS {
+			log.Println("Client: Read failed with status", fileInfoRead.Status, "on server", Servers[i%numServers])
+			err = os.NewError("chunk server could not read chunk")
+			continue
+		}
+
+		//the hash covers the whole chunk, so only a full fetch can be checked
+		if offset == 0 && info.Hash != nil && uint64(len(fileInfoRead.Data.Data)) == info.Size {
+			hasher := sha256.New()
+			hasher.Write(fileInfoRead.Data.Data)
+			if string(hasher.Sum()) != string(info.Hash) {
+				log.Printf("Client: checksum mismatch on chunk %d from %s\n\texpected: %x got: %x\n", info.ChunkID, Servers[i%numServers].String(), info.Hash, hasher.Sum())
+				corrupt[i%numServers] = true
+				c.ReportBadChunk(info.ChunkID, Servers[i%numServers])
+				err = os.NewError("chunk failed its checksum")
+				continue
+			}
+		}
+
+		log.Println("Client: Read chunk", fileArgsRead.ChunkID)
+		return fileInfoRead.Data.Data, nil
+	}
+
+	log.Println("Client: no good replica of chunk", info.ChunkID)
+	if err == nil {
+		err = os.NewError("no good replica of chunk")
+	}
+	return nil, err
+}
@@ -0,0 +1,212 @@
+package sfs
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"rpc"
+	"sync"
+	"time"
+)
+
+const POOL_IDLE_TIMEOUT = 60 * 1000000000 // close connections unused this long
+const POOL_MAX_IDLE = 4                     // idle connections kept per address
+
+// Pool keeps RPC connections open between calls, keyed by address, so a
+// busy caller doesn't pay for a TCP handshake on every call. A connection
+// that fails is thrown away, and a call that finds its pooled connection
+// dead is retried once on a fresh one. Connections left idle past the
+// idle timeout are closed in the background. A Pool is safe to use from
+// many goroutines at once.
+type Pool struct {
+	IdleTimeout int64 // ns
+	MaxIdle     int   // per address
+
+	lock    sync.Mutex
+	idle    map[string][]*pooledConn
+	reaping bool
+}
+
+type pooledConn struct {
+	client   *rpc.Client
+	lastUsed int64
+}
+
+// Conns is the pool shared by everything in a process that doesn't make
+// its own.
+var Conns = NewPool()
+
+func NewPool() *Pool {
+	p := new(Pool)
+	p.IdleTimeout = POOL_IDLE_TIMEOUT
+	p.MaxIdle = POOL_MAX_IDLE
+	p.idle = make(map[string][]*pooledConn)
+	return p
+}
+
+// idempotent lists the calls that do no harm if made twice, so they may be
+// made again after a connection breaks with one in flight. Anything not
+// here, ReadOpen for one since it may create a file or grant a lease, is
+// made at most once. BirthChunk is left out as a second one retires the
+// server the first registered, and DrainServer as a retry can race a
+// cancel.
+var idempotent = map[string]bool{
+	"Master.ReadDir":           true,
+	"Master.Stat":              true,
+	"Master.Validate":          true,
+	"Master.Quota":             true,
+	"Master.Chmod":             true,
+	"Master.Chown":             true,
+	"Master.SetLayout":         true,
+	"Master.RenewLease":        true,
+	"Master.ReplicationStatus": true,
+	"Master.FetchLog":          true,
+	"Master.BeatHeart":         true,
+	"Server.Read":              true,
+	"Server.Write":             true,
+	"Server.ReplicateChunk":    true,
+}
+
+// Unsent reports whether a call that failed with err never left this end:
+// it couldn't connect, or found its connection already closed.
+func Unsent(err os.Error) bool {
+	if err == rpc.ErrShutdown {
+		return true
+	}
+	_, isNet := err.(*net.OpError)
+	return isNet
+}
+
+// Retry reports whether a call to method that failed with err may be made
+// again, here or against another server: either it never went out, or it
+// did but making it twice does no harm. A call that may have been carried
+// out, and isn't safe to repeat, is left for the caller to sort out.
+func Retry(method string, err os.Error) bool {
+	return Unsent(err) || (Broken(err) && idempotent[method])
+}
+
+// Call makes an RPC to addr over a pooled connection, dialing one if none
+// is idle.
+func (p *Pool) Call(addr string, method string, args interface{}, reply interface{}) os.Error {
+	conn, reused, err := p.get(addr)
+	if err != nil {
+		return err
+	}
+
+	err = conn.Call(method, args, reply)
+	if err != nil && reused && Broken(err) && Retry(method, err) {
+		//the connection went bad while it sat idle; redial once
+		conn.Close()
+		conn, err = rpc.Dial("tcp", addr)
+		if err != nil {
+			return err
+		}
+		err = conn.Call(method, args, reply)
+	}
+
+	if err != nil && Broken(err) {
+		conn.Close()
+		return err
+	}
+	p.put(addr, conn)
+	return err
+}
+
+// Broken reports whether err means the connection a call went over is no
+// good any more, rather than that the far end returned an error.
+func Broken(err os.Error) bool {
+	if err == rpc.ErrShutdown || err == os.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, isNet := err.(*net.OpError)
+	return isNet
+}
+
+// Forget closes every idle connection to addr, as when it is known to be
+// gone.
+func (p *Pool) Forget(addr string) {
+	p.lock.Lock()
+	conns := p.idle[addr]
+	p.idle[addr] = nil, false
+	p.lock.Unlock()
+
+	for _, pc := range conns {
+		pc.client.Close()
+	}
+}
+
+func (p *Pool) get(addr string) (conn *rpc.Client, reused bool, err os.Error) {
+	p.lock.Lock()
+	conns := p.idle[addr]
+	if len(conns) > 0 {
+		pc := conns[len(conns)-1]
+		p.idle[addr] = conns[:len(conns)-1]
+		p.lock.Unlock()
+		return pc.client, true, nil
+	}
+	p.lock.Unlock()
+
+	conn, err = rpc.Dial("tcp", addr)
+	if err != nil {
+		log.Println("sfs: pool: dial", addr, "failed:", err)
+		return nil, false, err
+	}
+	return conn, false, nil
+}
+
+func (p *Pool) put(addr string, conn *rpc.Client) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.idle[addr]) >= p.MaxIdle {
+		conn.Close()
+		return
+	}
+	p.idle[addr] = append(p.idle[addr], &pooledConn{conn, time.Nanoseconds()})
+
+	if !p.reaping {
+		p.reaping = true
+		go p.reap()
+	}
+}
+
+// reap closes connections that have sat idle too long, checking every
+// half timeout while any are left.
+func (p *Pool) reap() {
+	for {
+		time.Sleep(p.IdleTimeout / 2)
+
+		var stale []*pooledConn
+		cutoff := time.Nanoseconds() - p.IdleTimeout
+
+		p.lock.Lock()
+		for addr, conns := range p.idle {
+			kept := conns[:0]
+			for _, pc := range conns {
+				if pc.lastUsed < cutoff {
+					stale = append(stale, pc)
+				} else {
+					kept = append(kept, pc)
+				}
+			}
+			if len(kept) == 0 {
+				p.idle[addr] = nil, false
+			} else {
+				p.idle[addr] = kept
+			}
+		}
+		done := len(p.idle) == 0
+		if done {
+			p.reaping = false
+		}
+		p.lock.Unlock()
+
+		for _, pc := range stale {
+			pc.client.Close()
+		}
+		if done {
+			return
+		}
+	}
+}
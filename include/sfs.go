@@ -4,44 +4,126 @@ import (
 	//	"os"
 	"container/list"
 	"container/vector"
+	"fmt"
 	"net"
+	"strings"
+	"time"
 )
 
 //const CHUNK_SIZE = 1024*1024*32 // 32 MB
-const CHUNK_SIZE = 1024*1024*4 // 4 MB
+const CHUNK_SIZE = 1024*1024*4 // 4 MB, the default; the master can pick others
+const MAX_CHUNK_SIZE = 1024*1024*64 // 64 MB
 //const CHUNK_SIZE = 1024                 // 32
 const HEARTBEAT_WAIT = 3 * 1000000000 // 15 seconds
-const NREPLICAS = 3
+const NREPLICAS = 3 // default replication factor
 const FAIL = -1
+const QUOTA_EXCEEDED = -2 // like FAIL, but the master refused for want of quota
 const SUCCESS = 0
 const BUSY = 2
 const NICE = 1
 const FORCE = 0
+const MASTER_PORT = "1338"
+const ERR_STANDBY = "master is a read-only standby"
+const ERR_PERMISSION = "permission denied"
+const ERR_QUOTA = "quota exceeded"
+const LEASE_DURATION = 60 * 1000000000 // 60 seconds unless renewed
+const DEFAULT_FILE_MODE = 0644
+const DEFAULT_DIR_MODE = 0755
+const CACHE_TTL = 5 * 1000000000 // how long a client trusts metadata before revalidating
+
+//lease modes for OpenArgs.Lease
+const (
+	LEASE_NONE = iota
+	LEASE_SHARED    // any number of holders; keeps the file from changing
+	LEASE_EXCLUSIVE // one holder, who alone may map chunks into the file
+)
+
+// Cred names the user a client acts for. It is advisory: nothing
+// authenticates it and the master takes it on trust, so permissions keep
+// honest users out of each other's files rather than stopping anyone
+// determined. For the same reason no name passes every check unless the
+// master is started with -superuser, and then anyone able to reach the
+// master can claim that name.
+type Cred struct {
+	User   string
+	Groups []string // the first is the primary group, given to new files
+}
 
+// Chunk carries only the bytes actually stored, at most MAX_CHUNK_SIZE of them.
 type Chunk struct {
-	Data [CHUNK_SIZE]byte
+	Data []byte
 }
 
 type ReadArgs struct {
 	ChunkID uint64
 	Nice    int
+	Offset  uint64 // first byte of the chunk to return
+	Length  uint64 // bytes to return; 0 means through the end of the chunk
 }
 
 type ReadReturn struct {
-	Data   Chunk
-	Status int
+	Data    Chunk
+	Status  int
+	Version uint64 // version of the copy that was read
 }
 
 type ReadDirArgs struct {
 	Prefix string
+	Attrs  bool // fill in Entries as well as FileNames
+	Cred   Cred
 }
 
 type ReadDirReturn struct {
 	FileNames []string
+	Entries   []FileAttr // with Attrs, one per name in FileNames
+	Version   uint64     // of the directory, for Validate
+}
+
+// ValidateArgs names files and directories whose cached metadata a client
+// wants to check.
+type ValidateArgs struct {
+	Files []string
+	Dirs  []string
+	Cred  Cred
+}
+
+// ValidateReturn has the current version of each, in the same order; 0
+// means it no longer exists.
+type ValidateReturn struct {
+	Files []uint64
+	Dirs  []uint64
+}
+
+// FileAttr is what the master knows about a file or directory. Times are
+// nanoseconds since the epoch.
+type FileAttr struct {
+	Name      string
+	IsDir     bool
+	Size      uint64
+	Chunks    int
+	ChunkSize uint64 // for a directory, what new files in it get
+	Replicas  int
+	Owner     string
+	Group     string
+	Mode      uint64 // permission bits
+	Ctime     int64  // attributes last changed
+	Mtime     int64  // contents last changed
+	Atime     int64  // last opened
+}
+
+type StatArgs struct {
+	Name string
+	Cred Cred
+}
+
+type StatReturn struct {
+	Status int
+	Attr   FileAttr
 }
 
 type MakeDirArgs struct {
 	DirName string
+	Cred    Cred
 }
 
 type MakeDirReturn struct {
@@ -51,16 +133,31 @@ type MakeDirReturn struct {
 type RemoveDirArgs struct {
 	DirName   string
 	Recursive bool
+	Cred      Cred
 }
 
 type RemoveDirReturn struct {
 	Status int
 }
 
+type RenameArgs struct {
+	From      string
+	To        string
+	Overwrite bool // replace a file, or empty directory, already at To
+	Cred      Cred
+}
+
+type RenameReturn struct {
+	Status int
+}
+
 type ChunkBirthArgs struct {
 	ChunkServerIP net.TCPAddr
 	Capacity      uint64
-	ChunkIDs      []uint64
+	BytesUsed     uint64
+	BytesLimit    uint64
+	Domain        string      // failure domain (rack, zone) the server sits in
+	Chunks        []ChunkInfo // ChunkID and Version of everything held
 }
 
 type ChunkBirthReturn struct {
@@ -82,7 +179,11 @@ type HeartbeatArgs struct {
 	ChunkServerIP net.TCPAddr
 	ChunkServerID uint64
 	Capacity      uint64
+	BytesUsed     uint64
+	BytesLimit    uint64
 	AddedChunks   []ChunkInfo
+	BadChunks     []uint64 // failed a scrub
+	MissingChunks []uint64 // vanished from the server's disk
 }
 
 type HeartbeatReturn struct {
@@ -92,6 +193,7 @@ type HeartbeatReturn struct {
 
 type DeleteArgs struct {
 	Name string
+	Cred Cred
 }
 
 type DeleteReturn struct {
@@ -106,33 +208,77 @@ type Status struct {
 type OpenArgs struct {
 	Name    string
 	NewFile bool
-	Lock    bool
+	Lease   int // LEASE_NONE, LEASE_SHARED or LEASE_EXCLUSIVE
 	Size    uint64
+	Access  uint64 // 4 to read, 2 to write, or both; 0 means read
+	Cred    Cred
 }
 
 type OpenReturn struct {
-	New   bool
-	Size  uint64      // bytes
-	Chunk []ChunkInfo // bytes
+	New       bool
+	Size      uint64      // bytes
+	Chunk     []ChunkInfo // bytes
+	ChunkSize uint64      // bytes per chunk for this file
+	Replicas  int
+
+	LeaseID       uint64 // 0 if no lease was asked for
+	LeaseDuration int64  // ns until the lease lapses unless renewed
+
+	Version uint64 // of the file's metadata, for Validate
+}
+
+type SetLayoutArgs struct {
+	Name      string // file or directory
+	ChunkSize uint64 // 0 leaves it alone; only files without data can change
+	Replicas  int    // 0 leaves it alone
+	Clear     bool   // drop existing overrides and inherit from the parent
+	Cred      Cred
+}
+
+type SetLayoutReturn struct {
+	Status int
 }
 
 type LockReleaseArgs struct {
-	Name string
+	Name    string
+	LeaseID uint64
 }
 
 type LockReleaseReturn struct {
 	Status int
 }
 
+type RenewLeaseArgs struct {
+	LeaseID uint64
+}
+
+type RenewLeaseReturn struct {
+	Status   int
+	Duration int64 // ns until the lease lapses again
+}
+
 type ReplicateChunkArgs struct {
 	ChunkID uint64
 	Servers []net.TCPAddr
+	Version uint64 // copies older than this are stale
+	Hash    []byte // what a good copy hashes to
 }
 
 type ReplicateChunkReturn struct {
 	Status int
 }
 
+type ReplicationStatusArgs struct {
+	List bool // also return the IDs of queued chunks
+}
+
+type ReplicationStatusReturn struct {
+	Queued   int // chunks waiting for more replicas
+	InFlight int // replications running now
+	Retrying int // queued chunks that have failed at least once
+	Chunks   []uint64
+}
+
 type GetNewChunkArgs struct {
 	Name  string
 	Count uint64
@@ -145,15 +291,26 @@ type GetNewChunkReturn struct {
 }
 
 type MapChunkToFileArgs struct {
-	Name   string
-	Offset int
-	Chunk  ChunkInfo
+	Name    string
+	Offset  int
+	Chunk   ChunkInfo
+	LeaseID uint64 // required if the file is leased
+	Cred    Cred
 }
 
 type MapChunkToFileReturn struct {
 	Status int
 }
 
+type ReportBadChunkArgs struct {
+	ChunkID uint64
+	Server  net.TCPAddr // replica whose data failed the checksum
+}
+
+type ReportBadChunkReturn struct {
+	Status int
+}
+
 type ReportWriteArgs struct {
 	Chunk ChunkInfo
 }
@@ -164,6 +321,54 @@ type ReportWriteReturn struct {
 
 type RemoveArgs struct {
 	Name string
+	Cred Cred
+}
+
+type ChmodArgs struct {
+	Name string
+	Mode uint64 // permission bits, e.g. 0644
+	Cred Cred
+}
+
+type ChmodReturn struct {
+	Status int
+}
+
+type ChownArgs struct {
+	Name  string
+	Owner string // "" leaves the owner alone
+	Group string // "" leaves the group alone
+	Cred  Cred
+}
+
+type ChownReturn struct {
+	Status int
+}
+
+type QuotaArgs struct {
+	Dir      string // a directory, or
+	User     string // a user
+	Set      bool   // set the limits below rather than just report
+	MaxBytes uint64 // 0 for no limit
+	MaxFiles uint64 // 0 for no limit
+	Cred     Cred
+}
+
+type QuotaReturn struct {
+	Status int
+	Quotas []QuotaInfo
+}
+
+// QuotaInfo is the usage and limits of a directory subtree, with Dir set,
+// or of everything one user owns, with User set. Bytes are logical file
+// sizes, before replication.
+type QuotaInfo struct {
+	Dir       string
+	User      string
+	UsedBytes uint64
+	UsedFiles uint64
+	MaxBytes  uint64
+	MaxFiles  uint64
 }
 
 type RemoveReturn struct {
@@ -172,9 +377,124 @@ type RemoveReturn struct {
 
 type Handle int
 
+// MasterAddr appends the default master port to addr unless it already
+// names one.
+func MasterAddr(addr string) string {
+	if strings.Index(addr, ":") != -1 {
+		return addr
+	}
+	return addr + ":" + MASTER_PORT
+}
+
+// ModeString renders permission bits the way ls -l does.
+func ModeString(mode uint64, dir bool) string {
+	buf := []byte("-rwxrwxrwx")
+	if dir {
+		buf[0] = 'd'
+	}
+	for i := 0; i < 9; i++ {
+		if mode&(1<<uint(8-i)) == 0 {
+			buf[i+1] = '-'
+		}
+	}
+	return string(buf)
+}
+
+// LongFormat renders a as one line of ls -l output.
+func LongFormat(a FileAttr) string {
+	owner, group := a.Owner, a.Group
+	if owner == "" {
+		owner = "-"
+	}
+	if group == "" {
+		group = "-"
+	}
+	mtime := time.SecondsToLocalTime(a.Mtime / 1000000000).Format("Jan _2 15:04 2006")
+	name := a.Name
+	if a.IsDir && !strings.HasSuffix(name, "/") {
+		name += "/"
+	}
+	return fmt.Sprintf("%s %d %-8s %-8s %12d %s %s", ModeString(a.Mode, a.IsDir), a.Replicas, owner, group, a.Size, mtime, name)
+}
+
 type ChunkInfo struct {
 	ChunkID uint64
 	Size    uint64
 	Servers []net.TCPAddr
 	Hash    []byte
+	Version uint64
+}
+
+type FetchLogArgs struct {
+	Seq           uint64 // last log entry the standby has applied
+	WantLocations bool
+	Cred          Cred // the standby asks as the superuser
+}
+
+type FetchLogReturn struct {
+	Checkpoint []byte   // set when Seq predates the primary's checkpoint
+	Records    [][]byte // log records newer than Seq, in order
+	Seq        uint64
+	Locations  []ChunkLocation
+}
+
+type ChunkLocation struct {
+	ChunkID uint64
+	Servers []net.TCPAddr
+}
+
+type DomainStatusArgs struct {
+	Domain string // "" for every domain
+}
+
+type DomainStatusReturn struct {
+	Domains []DomainInfo
+	Crowded int // chunks with every copy in one domain though others have room
+}
+
+type DomainInfo struct {
+	Name       string
+	Servers    int
+	Chunks     int
+	BytesUsed  uint64
+	BytesLimit uint64
+}
+
+type RebalanceArgs struct {
+	Start     bool
+	Stop      bool
+	Budget    int64   // bytes a second to move, 0 for the default
+	Threshold float64 // fill spread to balance down to, 0 for the default
+	Cred      Cred
+}
+
+type RebalanceReturn struct {
+	Status     int
+	Running    bool
+	Moved      int    // chunks moved since the rebalancer was started
+	BytesMoved uint64
+}
+
+type DrainServerArgs struct {
+	Server net.TCPAddr
+	Cancel bool // put a draining server back in service
+	Cred   Cred
+}
+
+type DrainServerReturn struct {
+	Status   int
+	Draining bool
+	Chunks   int  // chunks the server still holds
+	Pending  int  // of those, how many are short of replicas elsewhere
+	Unique   int  // of those, how many have no other copy at all
+	Done     bool // safe to shut the server down
+}
+
+type PromoteArgs struct {
+	Force bool // promote even if the primary is still answering
+	Cred  Cred
+}
+
+type PromoteReturn struct {
+	Status int
 }
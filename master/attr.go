@@ -0,0 +1,149 @@
+package master
+
+import (
+	"os"
+	"sync"
+	"time"
+	"../include/sfs"
+)
+
+var versionLock sync.Mutex
+var lastVersion uint64
+
+// nextVersion hands out versions for files and directories to tag their
+// metadata with. They start from the clock, so they keep going up across
+// restarts and a client never mistakes new metadata for what it cached.
+func nextVersion() uint64 {
+	versionLock.Lock()
+	defer versionLock.Unlock()
+
+	v := uint64(time.Nanoseconds())
+	if v <= lastVersion {
+		v = lastVersion + 1
+	}
+	lastVersion = v
+	return v
+}
+
+// sawVersion makes sure versions handed out from now on are newer than v,
+// one read back from the log or a checkpoint.
+func sawVersion(v uint64) {
+	versionLock.Lock()
+	defer versionLock.Unlock()
+
+	if v > lastVersion {
+		lastVersion = v
+	}
+}
+
+// length is the file's size: the bytes in all its chunks.
+func (i *inode) length() uint64 {
+	var n uint64
+	for j := 0; j < i.chunks.Len(); j++ {
+		n += i.chunks.At(j).(*chunk).size
+	}
+	return n
+}
+
+func (i *inode) attr(name string) (a sfs.FileAttr) {
+	a.Name = name
+	a.Size = i.size
+	a.Chunks = i.chunks.Len()
+	a.ChunkSize = i.chunkSize
+	a.Replicas = fileReplicas(name, i)
+	a.Owner = i.owner
+	a.Group = i.group
+	a.Mode = i.permissions
+	a.Ctime = i.ctime
+	a.Mtime = i.mtime
+	a.Atime = i.atime
+	return a
+}
+
+func (d *dirNode) attr(name string) (a sfs.FileAttr) {
+	a.Name = name
+	a.IsDir = true
+	a.ChunkSize = dirChunkSize(name)
+	a.Replicas = dirReplicas(name)
+	a.Owner = d.owner
+	a.Group = d.group
+	a.Mode = d.permissions
+	a.Ctime = d.ctime
+	a.Mtime = d.mtime
+	a.Atime = d.mtime
+	return a
+}
+
+// stat looks up the attributes of the file or directory at name. It
+// takes chunkLock, as mapping a chunk changes a file's size and version
+// under it, so the two are read together.
+func stat(name string) (a sfs.FileAttr, err os.Error) {
+	name, err = cleanPath(name)
+	if err != nil {
+		return a, err
+	}
+
+	chunkLock.Lock()
+	defer chunkLock.Unlock()
+
+	if file, err := lookupFile(name); err == nil {
+		return file.attr(name), nil
+	}
+
+	d, err := lookupDir(name)
+	if err != nil {
+		return a, os.NewError("no such file or directory")
+	}
+
+	return d.attr(name), nil
+}
+
+// Validate reports the current version of each file and directory named,
+// 0 for any that are gone, so a client can tell which of its cached
+// entries still hold without fetching them again.
+func (m *Master) Validate(args *sfs.ValidateArgs, ret *sfs.ValidateReturn) os.Error {
+	//versions change under chunkLock, along with what they stand for
+	chunkLock.Lock()
+	defer chunkLock.Unlock()
+
+	//what the caller may not look at reads as gone, so it gets refetched
+	//and refused there
+	ret.Files = make([]uint64, len(args.Files))
+	for i, name := range args.Files {
+		if checkSearch(&args.Cred, name) != nil {
+			continue
+		}
+		if file, err := lookupFile(name); err == nil {
+			ret.Files[i] = file.version
+		}
+	}
+
+	ret.Dirs = make([]uint64, len(args.Dirs))
+	for i, name := range args.Dirs {
+		if checkDir(&args.Cred, name, permRead) != nil {
+			continue
+		}
+		if d, err := lookupDir(name); err == nil {
+			ret.Dirs[i] = d.version
+		}
+	}
+
+	return nil
+}
+
+func (m *Master) Stat(args *sfs.StatArgs, ret *sfs.StatReturn) os.Error {
+	ret.Status = sfs.FAIL
+
+	if err := checkSearch(&args.Cred, args.Name); err != nil {
+		return err
+	}
+
+	a, err := stat(args.Name)
+	if err != nil {
+		return err
+	}
+
+	ret.Attr = a
+	ret.Status = sfs.SUCCESS
+	return nil
+}
@@ -0,0 +1,87 @@
+package master
+
+import (
+	"os"
+	"../include/sfs"
+)
+
+// domains counts c's live copies in each failure domain, leaving out
+// copies on draining servers since those are going away.
+func (c *chunk) domains() map[string]int {
+	held := make(map[string]int)
+	for i := 0; i < c.servers.Len(); i++ {
+		s := c.servers.At(i).(*server)
+		if !s.draining {
+			held[s.failureDomain()]++
+		}
+	}
+	return held
+}
+
+// spreadsTo reports whether a copy of c on s would be in a new failure
+// domain, or at least that no server with room in a new domain exists.
+func (c *chunk) spreadsTo(s *server) bool {
+	held := c.domains()
+	if held[s.failureDomain()] == 0 {
+		return true
+	}
+	return !roomOutside(held)
+}
+
+// roomOutside reports whether a server with free space sits in a domain
+// that isn't in held.
+func roomOutside(held map[string]int) bool {
+	for i := 0; i < sHeap.vec.Len(); i++ {
+		s := sHeap.vec.At(i).(*server)
+		if !s.full() && !s.draining && held[s.failureDomain()] == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// crowded reports whether every copy of a replicated chunk shares one
+// failure domain while another domain has room for one.
+func (c *chunk) crowded() bool {
+	if c.replicaTarget() < 2 || c.servers.Len() == 0 {
+		return false
+	}
+	held := c.domains()
+	return len(held) == 1 && roomOutside(held)
+}
+
+func (m *Master) DomainStatus(args *sfs.DomainStatusArgs, ret *sfs.DomainStatusReturn) os.Error {
+	chunkLock.Lock()
+	defer chunkLock.Unlock()
+
+	index := make(map[string]int)
+
+	for i := 0; i < sHeap.vec.Len(); i++ {
+		s := sHeap.vec.At(i).(*server)
+		name := s.failureDomain()
+		if args.Domain != "" && name != args.Domain {
+			continue
+		}
+
+		j, ok := index[name]
+		if !ok {
+			j = len(ret.Domains)
+			index[name] = j
+			ret.Domains = append(ret.Domains, sfs.DomainInfo{Name: name})
+		}
+
+		d := &ret.Domains[j]
+		d.Servers++
+		d.Chunks += s.chunks.Len()
+		d.BytesUsed += s.bytesUsed
+		d.BytesLimit += s.bytesLimit
+	}
+
+	for _, c := range chunks {
+		if c.crowded() {
+			ret.Crowded++
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+package master
+
+import (
+	"os"
+	"log"
+	"fmt"
+	"time"
+	"../include/sfs"
+)
+
+const DRAIN_WAIT = 10 * 1000000000 // how often draining servers are checked
+
+// drainingAddrs remembers which servers are being decommissioned by
+// address, so a draining server that restarts and is born again stays
+// draining. It is logged and checkpointed, so it outlives the master too.
+// Like drainedAddrs it is guarded by chunkLock.
+var drainingAddrs map[string]bool
+
+// drainedAddrs holds the draining servers already reported safe to stop.
+var drainedAddrs map[string]bool
+
+// keptReplicas counts c's copies on servers that aren't draining.
+func (c *chunk) keptReplicas() int {
+	n := 0
+	for i := 0; i < c.servers.Len(); i++ {
+		if !c.servers.At(i).(*server).draining {
+			n++
+		}
+	}
+	return n
+}
+
+// drainProgress reports how many chunks s still holds, how many of them
+// are short of their replica target without it, and how many have no
+// copy anywhere else.
+func (s *server) drainProgress() (held int, pending int, unique int) {
+	held = s.chunks.Len()
+	for i := 0; i < held; i++ {
+		c := s.chunks.At(i).(*chunk)
+		kept := c.keptReplicas()
+		if kept < c.replicaTarget() {
+			pending++
+		}
+		if kept == 0 {
+			unique++
+		}
+	}
+	return held, pending, unique
+}
+
+// DrainServer starts decommissioning a chunk server, or with Cancel puts
+// it back in service. A draining server gets no new chunks and each of
+// its chunks is copied elsewhere by the replication queue; once it holds
+// nothing the cluster needs, Done is set and it can be shut down. Calling
+// it again on a draining server just reports progress.
+func (m *Master) DrainServer(args *sfs.DrainServerArgs, ret *sfs.DrainServerReturn) os.Error {
+	if err := primaryOnly(); err != nil {
+		return err
+	}
+	if err := checkAdmin(&args.Cred); err != nil {
+		return err
+	}
+
+	ret.Status = sfs.FAIL
+
+	str := fmt.Sprintf("%s:%d", args.Server.IP.String(), args.Server.Port)
+
+	chunkLock.Lock()
+	_, ok := addrToServerMap[str]
+	change := args.Cancel == drainingAddrs[str]
+	chunkLock.Unlock()
+	if !ok {
+		return os.NewError("no such chunk server: " + str)
+	}
+
+	if change {
+		err := commit(&logEntry{Op: opDrain, Name: str, Clear: args.Cancel}, func() os.Error {
+			return drain(str, args.Cancel)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	chunkLock.Lock()
+	defer chunkLock.Unlock()
+
+	s, ok := addrToServerMap[str]
+	if !ok {
+		return os.NewError("no such chunk server: " + str)
+	}
+
+	ret.Draining = s.draining
+	ret.Chunks, ret.Pending, ret.Unique = s.drainProgress()
+	ret.Done = s.draining && ret.Pending == 0
+	ret.Status = sfs.SUCCESS
+	return nil
+}
+
+// drain starts decommissioning the chunk server at str, or with cancel
+// puts it back in service. The server needn't be up: one that isn't is
+// marked when it is born again. The caller holds chunkLock.
+func drain(str string, cancel bool) os.Error {
+	s, ok := addrToServerMap[str]
+
+	if cancel {
+		if drainingAddrs[str] {
+			log.Printf("master: drain: %s back in service\n", str)
+		}
+		if ok {
+			s.draining = false
+		}
+		drainingAddrs[str] = false, false
+		drainedAddrs[str] = false, false
+		return nil
+	}
+
+	if !drainingAddrs[str] {
+		log.Printf("master: drain: draining %s\n", str)
+	}
+	drainingAddrs[str] = true
+	if ok {
+		s.draining = true
+		if !standby {
+			for i := 0; i < s.chunks.Len(); i++ {
+				enqueueReplication(s.chunks.At(i).(*chunk))
+			}
+		}
+	}
+
+	return nil
+}
+
+// drainManager keeps an eye on draining servers: it requeues any of their
+// chunks the replication queue has let go of and says when each one is
+// safe to shut down.
+func drainManager() {
+	for {
+		time.Sleep(DRAIN_WAIT)
+
+		if standby {
+			continue
+		}
+
+		chunkLock.Lock()
+		for str := range drainingAddrs {
+			s, ok := addrToServerMap[str]
+			if !ok {
+				continue
+			}
+
+			held, pending, unique := s.drainProgress()
+			if pending == 0 {
+				if !drainedAddrs[str] {
+					log.Printf("master: drainManager: %s holds no data the cluster needs and can be shut down\n", str)
+					drainedAddrs[str] = true
+				}
+				continue
+			}
+
+			log.Printf("master: drainManager: %s still holds %d chunks, %d short elsewhere, %d with no other copy\n", str, held, pending, unique)
+			for i := 0; i < s.chunks.Len(); i++ {
+				enqueueReplication(s.chunks.At(i).(*chunk))
+			}
+		}
+		chunkLock.Unlock()
+	}
+}
+
+func init() {
+	drainingAddrs = make(map[string]bool)
+	drainedAddrs = make(map[string]bool)
+}
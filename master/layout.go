@@ -0,0 +1,197 @@
+package master
+
+import (
+	"os"
+	"log"
+	"path"
+	"../include/sfs"
+)
+
+// layout holds chunk size and replication overrides for a directory. A zero
+// field inherits from the parent directory, and ultimately from the cluster
+// defaults.
+type layout struct {
+	chunkSize uint64
+	replicas  int
+}
+
+var defaultChunkSize uint64 = sfs.CHUNK_SIZE
+var defaultReplicas int = sfs.NREPLICAS
+
+// SetDefaults sets the cluster wide chunk size and replication factor used
+// wherever no file or directory override applies.
+func SetDefaults(chunkSize uint64, replicas int) os.Error {
+	if chunkSize == 0 || chunkSize > sfs.MAX_CHUNK_SIZE {
+		return os.NewError("chunk size out of range")
+	}
+	if replicas < 1 {
+		return os.NewError("replication factor must be at least 1")
+	}
+
+	defaultChunkSize = chunkSize
+	defaultReplicas = replicas
+
+	log.Printf("master: SetDefaults: chunk size %d, %d replicas\n", chunkSize, replicas)
+
+	return nil
+}
+
+func (m *Master) SetLayout(args *sfs.SetLayoutArgs, ret *sfs.SetLayoutReturn) os.Error {
+	if err := primaryOnly(); err != nil {
+		return err
+	}
+
+	ret.Status = sfs.FAIL
+
+	if args.ChunkSize > sfs.MAX_CHUNK_SIZE {
+		return os.NewError("chunk size out of range")
+	}
+	if args.Replicas < 0 {
+		return os.NewError("replication factor must not be negative")
+	}
+	if err := checkOwner(&args.Cred, args.Name); err != nil {
+		return err
+	}
+
+	e := &logEntry{Op: opSetLayout, Name: args.Name, ChunkSize: args.ChunkSize, Replicas: args.Replicas, Clear: args.Clear}
+
+	err := commit(e, func() os.Error {
+		return setLayout(args.Name, args.ChunkSize, args.Replicas, args.Clear)
+	})
+	if err != nil {
+		return err
+	}
+
+	ret.Status = sfs.SUCCESS
+	return nil
+}
+
+// setLayout applies an override to a file or directory. Zero values leave
+// the current setting alone; clear drops all overrides first.
+func setLayout(name string, chunkSize uint64, replicas int, clear bool) os.Error {
+	file, isFile, _ := QueryFile(name)
+
+	if isFile {
+		if chunkSize != 0 && chunkSize != file.chunkSize {
+			if file.chunks.Len() != 0 {
+				return os.NewError("cannot change the chunk size of a file with data")
+			}
+			file.chunkSize = chunkSize
+		}
+		if clear {
+			file.replicas = 0
+		}
+		if replicas != 0 {
+			file.replicas = replicas
+		}
+		file.ctime = now()
+		file.version = nextVersion()
+
+		retarget(name, file)
+		return nil
+	}
+
+	d, err := lookupDir(name)
+	if err != nil {
+		return os.NewError("no such file or directory")
+	}
+
+	//what every directory below works out to now, to tell what changes
+	var dirs []string
+	walkDirs(name, func(dir string, sub *dirNode) {
+		dirs = append(dirs, dir)
+	})
+	before := make(map[string]layout)
+	for _, dir := range dirs {
+		before[dir] = layout{dirChunkSize(dir), dirReplicas(dir)}
+	}
+
+	l := new(layout)
+	if d.layout != nil && !clear {
+		*l = *d.layout
+	}
+	if chunkSize != 0 {
+		l.chunkSize = chunkSize
+	}
+	if replicas != 0 {
+		l.replicas = replicas
+	}
+	d.layout = l
+	d.ctime = now()
+	d.version = nextVersion()
+
+	//a cached directory or file whose layout moved has to be refetched
+	changed := make(map[string]bool)
+	for _, dir := range dirs {
+		was := before[dir]
+		if was.chunkSize == dirChunkSize(dir) && was.replicas == dirReplicas(dir) {
+			continue
+		}
+		changed[dir] = true
+		if sub, err := lookupDir(dir); err == nil {
+			sub.version = nextVersion()
+		}
+	}
+
+	//files below that inherit from here may have changed target
+	walkFiles(name, func(fileName string, file *inode) {
+		dir, _ := path.Split(fileName)
+		if file.replicas == 0 && changed[dir] {
+			file.version = nextVersion()
+		}
+		retarget(fileName, file)
+	})
+
+	return nil
+}
+
+// retarget resets the replica target of every chunk in a file to the
+// file's effective replication factor.
+func retarget(name string, file *inode) {
+	r := fileReplicas(name, file)
+	for j := 0; j < file.chunks.Len(); j++ {
+		file.chunks.At(j).(*chunk).replicas = r
+	}
+}
+
+// dirChunkSize is the chunk size a new file created in dir would get.
+func dirChunkSize(dir string) uint64 {
+	d, err := lookupDir(dir)
+	for ; err == nil && d != nil; d = d.parent {
+		if d.layout != nil && d.layout.chunkSize != 0 {
+			return d.layout.chunkSize
+		}
+	}
+	return defaultChunkSize
+}
+
+func dirReplicas(dir string) int {
+	d, err := lookupDir(dir)
+	for ; err == nil && d != nil; d = d.parent {
+		if d.layout != nil && d.layout.replicas != 0 {
+			return d.layout.replicas
+		}
+	}
+	return defaultReplicas
+}
+
+// fileReplicas is the replication factor that applies to name, whose inode
+// may be nil if the caller hasn't looked it up.
+func fileReplicas(name string, file *inode) int {
+	if file == nil {
+		file, _, _ = QueryFile(name)
+	}
+	if file != nil && file.replicas != 0 {
+		return file.replicas
+	}
+	dir, _ := path.Split(name)
+	return dirReplicas(dir)
+}
+
+// replicaTarget is how many live copies of c the master tries to keep.
+func (c *chunk) replicaTarget() int {
+	if c.replicas == 0 {
+		return defaultReplicas
+	}
+	return c.replicas
+}
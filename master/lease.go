@@ -0,0 +1,176 @@
+package master
+
+import (
+	"os"
+	"log"
+	"sync"
+	"time"
+	"../include/sfs"
+)
+
+const LEASE_SWEEP = sfs.LEASE_DURATION / 4 // how often expired leases are reaped
+
+// lease is a time-bounded claim on a file. Any number of shared leases may
+// be live at once, but an exclusive lease excludes every other lease.
+// Leases are not logged: a restarted or newly promoted master starts with
+// none, and clients find out when their next renewal fails.
+type lease struct {
+	id      uint64
+	mode    int
+	file    *inode
+	expires int64
+}
+
+var leaseLock sync.Mutex
+var leases map[uint64](*lease)
+var nextLease uint64 = 1
+
+var errLeased = os.NewError("file is leased")
+
+func (l *lease) live(now int64) bool {
+	return now < l.expires
+}
+
+// grantLease hands out a lease of the given mode on file, or fails if a
+// live lease held by someone else conflicts with it. The caller holds
+// chunkLock, so a grant can't slip in while a change checks for leases.
+func grantLease(file *inode, mode int) (*lease, os.Error) {
+	if mode != sfs.LEASE_SHARED && mode != sfs.LEASE_EXCLUSIVE {
+		return nil, os.NewError("unknown lease mode")
+	}
+
+	leaseLock.Lock()
+	defer leaseLock.Unlock()
+
+	now := time.Nanoseconds()
+	for _, l := range file.leases {
+		if !l.live(now) {
+			continue
+		}
+		if mode == sfs.LEASE_EXCLUSIVE || l.mode == sfs.LEASE_EXCLUSIVE {
+			return nil, os.NewError("Cannot get lease: file is leased")
+		}
+	}
+
+	l := new(lease)
+	l.id = nextLease
+	nextLease++
+	l.mode = mode
+	l.file = file
+	l.expires = now + sfs.LEASE_DURATION
+
+	if file.leases == nil {
+		file.leases = make(map[uint64](*lease))
+	}
+	file.leases[l.id] = l
+	leases[l.id] = l
+
+	return l, nil
+}
+
+// canMutate reports whether a caller holding leaseID (0 for none) may
+// change file. That is the case when nobody holds a live lease on it, or
+// when the caller's own lease is a live exclusive one.
+func canMutate(file *inode, leaseID uint64) bool {
+	leaseLock.Lock()
+	defer leaseLock.Unlock()
+
+	now := time.Nanoseconds()
+	for id, l := range file.leases {
+		if !l.live(now) {
+			continue
+		}
+		if id != leaseID || l.mode != sfs.LEASE_EXCLUSIVE {
+			return false
+		}
+	}
+	return true
+}
+
+// checkUnleased fails if anyone holds a live lease on the file at name,
+// or on any file below the directory at name. Deletes and renames take no
+// lease of their own, so even a lease's holder gives it up first. The
+// caller holds chunkLock, which grants are made under too, so no lease
+// comes between the check and the change.
+func checkUnleased(name string) os.Error {
+	if file, isFile, _ := QueryFile(name); isFile {
+		if !canMutate(file, 0) {
+			return errLeased
+		}
+		return nil
+	}
+
+	var err os.Error
+	walkFiles(name, func(p string, file *inode) {
+		if err == nil && !canMutate(file, 0) {
+			err = errLeased
+		}
+	})
+	return err
+}
+
+func dropLease(l *lease) {
+	l.file.leases[l.id] = l, false
+	leases[l.id] = l, false
+}
+
+func (m *Master) RenewLease(args *sfs.RenewLeaseArgs, ret *sfs.RenewLeaseReturn) os.Error {
+	if err := primaryOnly(); err != nil {
+		return err
+	}
+
+	ret.Status = sfs.FAIL
+
+	leaseLock.Lock()
+	defer leaseLock.Unlock()
+
+	now := time.Nanoseconds()
+	l, ok := leases[args.LeaseID]
+	if !ok || !l.live(now) {
+		return os.NewError("lease expired")
+	}
+
+	l.expires = now + sfs.LEASE_DURATION
+
+	ret.Status = sfs.SUCCESS
+	ret.Duration = sfs.LEASE_DURATION
+	return nil
+}
+
+func (m *Master) ReleaseLock(args *sfs.LockReleaseArgs, ret *sfs.LockReleaseReturn) os.Error {
+	if err := primaryOnly(); err != nil {
+		return err
+	}
+
+	ret.Status = sfs.FAIL
+
+	leaseLock.Lock()
+	defer leaseLock.Unlock()
+
+	l, ok := leases[args.LeaseID]
+	if !ok {
+		return os.NewError("no such lease")
+	}
+
+	dropLease(l)
+
+	ret.Status = sfs.SUCCESS
+	return nil
+}
+
+// expireLeases revokes leases whose holders stopped renewing them.
+func expireLeases() {
+	for {
+		time.Sleep(LEASE_SWEEP)
+
+		leaseLock.Lock()
+		now := time.Nanoseconds()
+		for id, l := range leases {
+			if !l.live(now) {
+				log.Printf("master: lease %d expired\n", id)
+				dropLease(l)
+			}
+		}
+		leaseLock.Unlock()
+	}
+}
@@ -2,7 +2,6 @@ package master
 
 import (
 	"net"
-	"./trie"
 	"log"
 	"os"
 	"fmt"
@@ -11,15 +10,19 @@ import (
 	"container/heap"
 	"../include/sfs"
 	"rpc"
-	"strings"
-	"rand"
-	"math"
 	"os/signal"
 	"runtime"
+	"path"
+	"sync"
 )
 
-var t *trie.Trie
 var nextChunk uint64 = 1
+
+//versions handed out with chunk IDs no file has mapped yet, under versionLock
+var allocated = make(map[uint64]uint64)
+
+const ALLOC_EXPIRY = 10 * 60 * 1000000000 // how long a handed out chunk ID waits to be mapped
+
 var nextChunkServerID uint64 = 0
 var serverIndex uint64 = 0
 var sHeap *serverHeap
@@ -31,12 +34,26 @@ var hashToChunkMap map[string](*chunk)
 
 var heartbeatMonitors map[uint64](chan int64)
 
+// chunkLock guards the chunk and server tables above and sHeap, along with
+// each chunk's server list and each server's chunk lists and counters.
+// It is taken after oplog.lock and before nsLock, and never held across
+// an RPC.
+var chunkLock sync.Mutex
+
 type inode struct {
 	name        string
 	permissions uint64
+	owner       string
+	group       string
+	ctime       int64  // attributes last changed
+	mtime       int64  // contents last changed
+	atime       int64  // last opened
+	version     uint64 // changes whenever the chunk list or attributes do
 	size        uint64
-	lock        bool
+	leases      map[uint64](*lease)
 	chunks      *vector.Vector
+	chunkSize   uint64 // fixed when the file is created
+	replicas    int    // 0 inherits from the directory
 }
 
 type chunk struct {
@@ -45,34 +62,90 @@ type chunk struct {
 	servers *vector.Vector
 	hash	[]byte
 	refCt	uint64
+	replicas int // replica target; 0 means the cluster default
+	version uint64 // bumped on each write; older replicas are stale
 }
 
 type Master int
 
+var errExists = os.NewError("file already exists")
+
 func (m *Master) ReadOpen(args *sfs.OpenArgs, info *sfs.OpenReturn) os.Error {
 
-	if sHeap.vec.Len() == 0 {
+	if standby && (args.NewFile || args.Lease != sfs.LEASE_NONE) {
+		return os.NewError(sfs.ERR_STANDBY)
+	}
+
+	chunkLock.Lock()
+	noServers := sHeap.vec.Len() == 0
+	chunkLock.Unlock()
+	if !standby && noServers {
 		err := os.NewError("No chunk servers!")
 		return err
 	}
-	file, newFile, err := OpenFile(args.Name, args.NewFile)
+	var file *inode
+	var newFile bool
+	var err os.Error
+
+	owner, group := args.Cred.User, primaryGroup(&args.Cred)
+
+	if args.NewFile {
+		dir, _ := path.Split(args.Name)
+		e := &logEntry{Op: opCreateFile, Name: args.Name, ChunkSize: dirChunkSize(dir), Owner: owner, Group: group}
+
+		//look and create in one step, so two creators can't both see no file
+		err = commit(e, func() os.Error {
+			if _, exists, _ := QueryFile(args.Name); exists {
+				return errExists
+			}
+			if err := checkParent(&args.Cred, args.Name, permWrite); err != nil {
+				return err
+			}
+			if overQuota(args.Name, owner, 0, 1) {
+				return errQuota
+			}
+			file, newFile, err = OpenFile(args.Name, true, owner, group)
+			return err
+		})
+		if err == errExists {
+			err = nil
+		}
+	}
 	log.Println("CREATE? ", args.NewFile)
-	
-	if file == nil {
+
+	if err == nil && file == nil {
+		err = checkFile(&args.Cred, args.Name, openAccess(args))
+		if err == nil {
+			file, newFile, err = OpenFile(args.Name, false, owner, group)
+		}
+	}
+	if err != nil {
+		log.Printf("ReadOpen: %s refused to %s: %s\n", args.Name, args.Cred.User, err.String())
 		return err
 	}
 	
-	if newFile && !args.Lock {
-		file.lock = false
-	} else if file.lock && args.Lock {
-		err := os.NewError("Cannot get lock")
-		return err
-	} else if args.Lock && !file.lock {
-		file.lock = true
+	if args.Lease != sfs.LEASE_NONE {
+		chunkLock.Lock()
+		l, err := grantLease(file, args.Lease)
+		chunkLock.Unlock()
+		if err != nil {
+			return err
+		}
+		info.LeaseID = l.id
+		info.LeaseDuration = sfs.LEASE_DURATION
 	}
 
+	file.atime = time.Nanoseconds()
+
+	//before the chunks, so a change while they are copied makes this stale
+	info.Version = file.version
 	info.New = newFile
 	info.Size = file.size
+	info.ChunkSize = file.chunkSize
+	info.Replicas = fileReplicas(args.Name, file)
+
+	chunkLock.Lock()
+	defer chunkLock.Unlock()
 
 	info.Chunk = make([]sfs.ChunkInfo, file.chunks.Len())
 	
@@ -92,43 +165,113 @@ func (m *Master) ReadOpen(args *sfs.OpenArgs, info *sfs.OpenReturn) os.Error {
 	return err
 }
 
+// openAccess is the permission an open asks for: what the client said it
+// wants, reading if it said nothing, and writing too for an exclusive lease.
+func openAccess(args *sfs.OpenArgs) uint64 {
+	want := args.Access & (permRead | permWrite)
+	if want == 0 {
+		want = permRead
+	}
+	if args.Lease == sfs.LEASE_EXCLUSIVE {
+		want |= permWrite
+	}
+	return want
+}
+
 func (m *Master) MapChunkToFile(args *sfs.MapChunkToFileArgs, ret *sfs.MapChunkToFileReturn) os.Error {
-	file, ok , error := QueryFile(args.Name)
+	if err := primaryOnly(); err != nil {
+		return err
+	}
+	if err := checkFile(&args.Cred, args.Name, permWrite); err != nil {
+		return err
+	}
+
+	log.Printf("master: MapChunkToFile: ChunkID: %d  Offset: %d  nservers: %d Hash: %x\n", args.Chunk.ChunkID, args.Offset, len(args.Chunk.Servers), args.Chunk.Hash)
+
+	e := &logEntry{Op: opMapChunk, Name: args.Name, Offset: args.Offset, ChunkID: args.Chunk.ChunkID, Size: args.Chunk.Size, Hash: args.Chunk.Hash}
+
+	return commit(e, func() os.Error {
+		//checked here, so no lease or other write comes between check and map
+		file, ok, error := QueryFile(args.Name)
+		if !ok {
+			log.Printf("master: MapChunkToFile: File %s does not exist\n", args.Name)
+			return error
+		}
+		if !canMutate(file, args.LeaseID) {
+			log.Printf("master: MapChunkToFile: File %s is leased to someone else\n", args.Name)
+			return errLeased
+		}
+		if overQuota(args.Name, file.owner, growth(file, args.Offset, args.Chunk.Size), 0) {
+			log.Printf("master: MapChunkToFile: File %s is over quota\n", args.Name)
+			return errQuota
+		}
+
+		//the version is the one the master gave out, whatever the client says
+		info := args.Chunk
+		version, ok := chunkVersion(info.ChunkID)
+		if !ok {
+			log.Printf("master: MapChunkToFile: chunk %d was never handed out\n", info.ChunkID)
+			return os.NewError("unknown chunk")
+		}
+		info.Version = version
+		e.Version = version
+		return mapChunkToFile(args.Name, args.Offset, info)
+	})
+}
+
+func mapChunkToFile(name string, offset int, info sfs.ChunkInfo) os.Error {
+	file, ok, error := QueryFile(name)
 
 	if !ok {
-		log.Printf("master: MapChunkToFile: File %s does not exist\n", args.Name)
 		return error
 	}
 
-	log.Printf("master: MapChunkToFile: ChunkID: %d  Offset: %d  nservers: %d Hash: %x\n", args.Chunk.ChunkID, args.Offset, len(args.Chunk.Servers), args.Chunk.Hash)
-	
-	thisChunk, ok := chunks[args.Chunk.ChunkID]
+	thisChunk, ok := chunks[info.ChunkID]
 	
 	if !ok {
 		thisChunk = new(chunk)
 
-		thisChunk.chunkID = args.Chunk.ChunkID
-		thisChunk.size = args.Chunk.Size
+		thisChunk.chunkID = info.ChunkID
+		thisChunk.size = info.Size
+		thisChunk.version = info.Version
 		thisChunk.servers = new(vector.Vector)
-		for i := 0; i < len(args.Chunk.Servers); i++ {
-			thisChunk.AssociateServer(addrToServerMap[args.Chunk.Servers[i].String()])
+		for i := 0; i < len(info.Servers); i++ {
+			thisChunk.AssociateServer(addrToServerMap[info.Servers[i].String()])
 		}
-		thisChunk.hash = args.Chunk.Hash
+		thisChunk.hash = info.Hash
+		setAllocated(info.ChunkID, 0, false)
 	}
 	
-	_, err := file.MapChunk(args.Offset, thisChunk)
+	old := file.size
+	_, err := file.MapChunk(offset, thisChunk)
 
 	if err != nil {
 		return os.NewError("Could not add chunk! Ruh roh")
 	}
+
+	file.size = file.length()
+	chargeFile(name, file.owner, int64(file.size)-int64(old))
+	file.mtime = now()
+	file.version = nextVersion()
+
+	//a chunk shared by several files keeps the highest target among them
+	r := fileReplicas(name, file)
+	if r > thisChunk.replicas {
+		thisChunk.replicas = r
+	}
 	
 	return nil
 }
 
 func (m *Master) GetNewChunk(args *sfs.GetNewChunkArgs, ret *sfs.GetNewChunkReturn) os.Error {
+	if err := primaryOnly(); err != nil {
+		return err
+	}
+
 	ok := false
 	var thisChunk *chunk
-		
+
+	chunkLock.Lock()
 	if args.Hash != nil {
 		thisChunk, ok = hashToChunkMap[string(args.Hash)]
 	}
@@ -138,6 +281,7 @@ func (m *Master) GetNewChunk(args *sfs.GetNewChunkArgs, ret *sfs.GetNewChunkRetu
 		ret.Info.ChunkID = thisChunk.chunkID
 		ret.Info.Size = thisChunk.size
 		ret.Info.Hash = thisChunk.hash
+		ret.Info.Version = thisChunk.version
 		ret.Info.Servers = make([]net.TCPAddr, thisChunk.servers.Len())
 		
 		for cnt1 := 0; cnt1 < thisChunk.servers.Len(); cnt1++ {
@@ -145,24 +289,39 @@ func (m *Master) GetNewChunk(args *sfs.GetNewChunkArgs, ret *sfs.GetNewChunkRetu
 		}
 		
 		ret.NewChunk = false
+		chunkLock.Unlock()
 	} else {
-		log.Printf("GetNewChunk: Hash: %x ChunkID: %d\n", args.Hash, nextChunk)
-		ret.Info.ChunkID = nextChunk
-		ret.Info.Hash = args.Hash
+		//the ID is logged under oplog.lock, which comes first
+		chunkLock.Unlock()
+		//a file with no room left for even one more byte gets no more chunks
+		id, version, err := allocChunkID(func() os.Error {
+			if file, err := lookupFile(args.Name); err == nil && overQuota(args.Name, file.owner, 1, 0) {
+				log.Printf("GetNewChunk: %s is over quota\n", args.Name)
+				return errQuota
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
 
-		nextChunk++
+		log.Printf("GetNewChunk: Hash: %x ChunkID: %d Version: %d\n", args.Hash, id, version)
+		ret.Info.ChunkID = id
+		ret.Info.Hash = args.Hash
+		ret.Info.Version = version
 
-		var nreps int
+		chunkLock.Lock()
+		defer chunkLock.Unlock()
 
-		if sHeap.vec.Len() < sfs.NREPLICAS {
-			nreps = sHeap.vec.Len()
-		} else {
-			nreps = sfs.NREPLICAS
+		picked := sHeap.pickServers(fileReplicas(args.Name, nil), nil, nil)
+		if len(picked) == 0 {
+			return os.NewError("No chunk servers with free space!")
 		}
 
-		ret.Info.Servers = make([]net.TCPAddr, nreps)
-		for i := 0; i < nreps; i++ {
-			ret.Info.Servers[i] = sHeap.vec.At(i).(*server).addr
+		ret.Info.Servers = make([]net.TCPAddr, len(picked))
+		for i, s := range picked {
+			ret.Info.Servers[i] = s.addr
+			s.writeLoad++
 		}
 		ret.NewChunk = true
 	}
@@ -176,114 +335,237 @@ func (m *Master) ReportWrite(args *sfs.ReportWriteArgs, ret *sfs.ReportWriteRetu
 }
 
 func (m *Master) ReadDir(args *sfs.ReadDirArgs, ret *sfs.ReadDirReturn) os.Error {
-	var lookupPath string
-	
-	if args.Prefix == "/" {
-		lookupPath = "/"
-	} else {
-		lookupPath = strings.TrimRight(args.Prefix, "/")
-	}
-	
-	log.Printf("ReadDir: prefix %s, trimmed: %s\n", args.Prefix, lookupPath)
-	
-	dirs, files, err := t.ReadDir(lookupPath)
-	
-	if err != nil {
-		log.Printf("ReadDir: err: %+v\n", err)
+	if err := checkDir(&args.Cred, args.Prefix, permRead); err != nil {
 		return err
 	}
-	
-	var cnt int
-	if dirs != nil {
-		cnt = dirs.Len()		
-	} else {
-		cnt = 0
-	}
-	
-	retSlice := make([]string, cnt + len(files))
 
-	var i int
-	for i = 0; i < cnt; i++ {
-		retSlice[i] = dirs.At(i) + "/"
-	}
+	names, version, err := listDir(args.Prefix)
 	
-	log.Printf("ReadDir: retSlice dirs -- %+v\n", retSlice)
-	log.Printf("ReadDir: retSlice file -- %+v\n", files)
-	
-	for k, _ := range files {
-		retSlice[i] = k
-		i++
+	if err != nil {
+		log.Printf("ReadDir: prefix %s, err: %+v\n", args.Prefix, err)
+		return err
 	}
 		
-	ret.FileNames = retSlice
+	ret.FileNames = names
+	ret.Version = version
+
+	if args.Attrs {
+		dir, _ := cleanPath(args.Prefix)
+		ret.Entries = make([]sfs.FileAttr, 0, len(names))
+		for _, name := range names {
+			a, err := stat(path.Join(dir, name))
+			if err != nil {
+				//removed since we listed it
+				continue
+			}
+			a.Name = name
+			ret.Entries = append(ret.Entries, a)
+		}
+	}
 	
-	log.Printf("ReadDir: retSlice -- %+v\n", retSlice)
+	log.Printf("ReadDir: %s -- %+v\n", args.Prefix, names)
 
 	return nil
 }
 
 func (m *Master) MakeDir(args *sfs.MakeDirArgs, ret *sfs.MakeDirReturn) os.Error {
-	err := t.AddDir(args.DirName)
-	
-	return err
+	if err := primaryOnly(); err != nil {
+		return err
+	}
+
+	if err := checkParent(&args.Cred, args.DirName, permWrite); err != nil {
+		return err
+	}
+
+	owner, group := args.Cred.User, primaryGroup(&args.Cred)
+
+	return commit(&logEntry{Op: opMakeDir, Name: args.DirName, Owner: owner, Group: group}, func() os.Error {
+		return makeDir(args.DirName, owner, group)
+	})
 }
 func (m *Master) RemoveDir(args *sfs.RemoveDirArgs, ret *sfs.RemoveDirReturn) os.Error {
-	err := t.RemoveDir(args.DirName)
+	if err := primaryOnly(); err != nil {
+		return err
+	}
+
+	ret.Status = sfs.FAIL
+
+	if err := checkParent(&args.Cred, args.DirName, permWrite); err != nil {
+		return err
+	}
+	if args.Recursive {
+		if err := checkTree(&args.Cred, args.DirName); err != nil {
+			return err
+		}
+	}
+
+	err := commit(&logEntry{Op: opRemoveDir, Name: args.DirName, Recursive: args.Recursive}, func() os.Error {
+		if err := checkUnleased(args.DirName); err != nil {
+			return err
+		}
+		return RemoveDir(args.DirName, args.Recursive)
+	})
 	
-	DumpTrie()
+	DumpNamespace()
 	
+	if err == nil {
+		ret.Status = sfs.SUCCESS
+	}
 	return err
 }
 
+// RemoveDir removes a directory, and with recursive everything below it,
+// unmapping each removed file's chunks so their replicas get evicted.
+func RemoveDir(name string, recursive bool) os.Error {
+	files, err := removeDir(name, recursive)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		for j := 0; j < file.chunks.Len(); j++ {
+			file.chunks.At(j).(*chunk).unmapChunk()
+		}
+	}
+
+	if len(files) > 0 {
+		log.Printf("RemoveDir: %s: removed %d files\n", name, len(files))
+	}
+	return nil
+}
+
+func (m *Master) Rename(args *sfs.RenameArgs, ret *sfs.RenameReturn) os.Error {
+	if err := primaryOnly(); err != nil {
+		return err
+	}
+
+	ret.Status = sfs.FAIL
+
+	if err := checkParent(&args.Cred, args.From, permWrite); err != nil {
+		return err
+	}
+	if err := checkParent(&args.Cred, args.To, permWrite); err != nil {
+		return err
+	}
+
+	e := &logEntry{Op: opRename, Name: args.From, NewName: args.To, Overwrite: args.Overwrite}
+	err := commit(e, func() os.Error {
+		if err := checkUnleased(args.From); err != nil {
+			return err
+		}
+		if err := checkUnleased(args.To); err != nil {
+			return err
+		}
+		return Rename(args.From, args.To, args.Overwrite)
+	})
+	if err != nil {
+		log.Printf("Rename: %s -> %s: %s\n", args.From, args.To, err.String())
+		return err
+	}
+
+	ret.Status = sfs.SUCCESS
+	return nil
+}
+
+// Rename moves a file or directory in one step. A file it overwrites gives
+// up its chunks the way a deleted one does.
+func Rename(from string, to string, overwrite bool) os.Error {
+	replaced, err := rename(from, to, overwrite)
+	if err != nil {
+		return err
+	}
+
+	if replaced != nil {
+		for j := 0; j < replaced.chunks.Len(); j++ {
+			replaced.chunks.At(j).(*chunk).unmapChunk()
+		}
+	}
+
+	//a file moved under a different directory may inherit another layout
+	if file, isFile, _ := QueryFile(to); isFile {
+		retarget(to, file)
+	} else {
+		walkFiles(to, retarget)
+	}
+
+	return nil
+}
+
 func (m *Master) RemoveFile(args *sfs.RemoveArgs, result *sfs.RemoveReturn) os.Error {
+	if err := primaryOnly(); err != nil {
+		return err
+	}
+
 	result.Success = true
-	name := args.Name
 
-	i, exists , _:= QueryFile(name)
-	if !exists {
+	if err := checkParent(&args.Cred, args.Name, permWrite); err != nil {
+		result.Success = false
+		return err
+	}
+
+	err := commit(&logEntry{Op: opRemoveFile, Name: args.Name}, func() os.Error {
+		if err := checkUnleased(args.Name); err != nil {
+			return err
+		}
+		return RemoveFile(args.Name)
+	})
+	if err != nil {
+		result.Success = false
+	}
+	return err
+}
+
+func RemoveFile(name string) os.Error {
+	i, err := removeFileNode(name)
+	if err != nil {
 		log.Printf("RemoveFile: file %s does not exist\n", name)
 		err := os.NewError("You are trying to delete a file that doesn't exist.")
-		result.Success = false
 		return err
 	} else {
 		for j := 0; j < i.chunks.Len(); j++ {
 			i.chunks.At(j).(*chunk).unmapChunk()
 		}
-
-		empty := t.Remove(name)
-
-		if empty {
-			log.Printf("There are no more files in the trie\n")
-		}
 	}
 	return nil
 }
 
 func (m *Master) BirthChunk(args *sfs.ChunkBirthArgs, info *sfs.ChunkBirthReturn) os.Error {
+	if err := primaryOnly(); err != nil {
+		return err
+	}
+
+	chunkLock.Lock()
+	defer chunkLock.Unlock()
 
 	s := AddServer(args.ChunkServerIP, args.Capacity)
+	s.bytesUsed = args.BytesUsed
+	s.bytesLimit = args.BytesLimit
+	s.domain = args.Domain
 	
 	log.Printf("Server (%s) got chunk ID (%d)\n", args.ChunkServerIP.String(), s.id)
 	
 	go s.monitorServerBeats(heartbeatMonitors[s.id])
 	
 	
-	if args.ChunkIDs != nil {
-		for _, id := range args.ChunkIDs {
-			c, ok := chunks[id]
+	if args.Chunks != nil {
+		for _, held := range args.Chunks {
+			c, ok := chunks[held.ChunkID]
 			
-			if ok {
+			if !ok {
+				//deleted while the server was away
+				s.evictedChunks.Push(held.ChunkID)
+			} else if c.checkReplica(s, held.Version) {
 				AssociateChunkAndServer(c, s)
 			}
 		}
-	}else{
-		thisMap := populateServer(s)
-		/*if thisMap == nil {
-			log.Fatal("error populating server %v\n", s);
-		}*/
-		info.ChunksToGet = thisMap
 	}
 
+	thisMap := populateServer(s)
+	/*if thisMap == nil {
+		log.Fatal("error populating server %v\n", s);
+	}*/
+	info.ChunksToGet = thisMap
+
 	info.ChunkServerID = s.id
 	
 	log.Println("Birthed a Chunk Server!\n")
@@ -291,32 +573,39 @@ func (m *Master) BirthChunk(args *sfs.ChunkBirthArgs, info *sfs.ChunkBirthReturn
 	return nil
 }
 
-func (m *Master) ReleaseLock(args *sfs.LockReleaseArgs, ret *sfs.LockReleaseReturn) os.Error {
-	file, exists ,_:= QueryFile(args.Name)
-	if !exists {
-		ret.Status = -1
-		return os.NewError("File does not exist")
+func (m *Master) DeleteFile(args *sfs.DeleteArgs, ret *sfs.DeleteReturn) os.Error {
+	if err := primaryOnly(); err != nil {
+		return err
 	}
-	file.lock = false
-	ret.Status = -1
-	return nil
-}
 
-func (m *Master) DeleteFile(args *sfs.DeleteArgs, ret *sfs.DeleteReturn) os.Error {
 	log.Printf("DeleteFile: args -- %+v\n", args)
-	err := DeleteFile(args.Name)
+	if err := checkParent(&args.Cred, args.Name, permWrite); err != nil {
+		return err
+	}
+	err := commit(&logEntry{Op: opDeleteFile, Name: args.Name}, func() os.Error {
+		if err := checkUnleased(args.Name); err != nil {
+			return err
+		}
+		return DeleteFile(args.Name)
+	})
 	
 	ret.Status = (err == nil)
 	
-	DumpTrie()
+	DumpNamespace()
 	 
 	return err
 }
 
 func (m *Master) BeatHeart(args *sfs.HeartbeatArgs, info *sfs.HeartbeatReturn) os.Error {
+	if err := primaryOnly(); err != nil {
+		return err
+	}
+
 	str := fmt.Sprintf("%s:%d", args.ChunkServerIP.IP.String(), args.ChunkServerIP.Port)
 	//log.Printf("BeatHeart: %s's HEART IS BEATING\n", str)
 
+	chunkLock.Lock()
+
 	//find the server who's heart is beating
 	server, servOK := servers[args.ChunkServerID]
 	_, servOK1 := addrToServerMap[str]
@@ -328,11 +617,16 @@ func (m *Master) BeatHeart(args *sfs.HeartbeatArgs, info *sfs.HeartbeatReturn) o
 	if servOK == false {
 		log.Printf("BEATHEART1 : Server (%s) not in server map; telling it to rebirth itself a la Madonna\n", str)
 		info.Accepted = false
+		chunkLock.Unlock()
 		return nil
 	}
 	
 	info.Accepted = true
 
+	server.bytesUsed = args.BytesUsed
+	server.bytesLimit = args.BytesLimit
+	server.writeLoad /= 2
+
 	//if somethings changed, update the server, heapify
 	if server.capacity != args.Capacity || args.AddedChunks != nil {
 		server.capacity = args.Capacity
@@ -342,7 +636,7 @@ func (m *Master) BeatHeart(args *sfs.HeartbeatArgs, info *sfs.HeartbeatReturn) o
 			//chunk , chunkOK := chunks[args.AddedChunks.At(cnt).(*chunk).chunkID]
 			chunk, chunkOK := chunks[args.AddedChunks[cnt].ChunkID]
 			//log.Printf("Herp dDerp %d\n", args.AddedChunks[0].ChunkID)
-			if chunkOK == true {
+			if chunkOK == true && chunk.checkReplica(server, args.AddedChunks[cnt].Version) {
 				//server.chunks.Push(chunk)
 				//chunk.servers.Push(server)
 				AssociateChunkAndServer(chunk, server)
@@ -353,11 +647,31 @@ func (m *Master) BeatHeart(args *sfs.HeartbeatArgs, info *sfs.HeartbeatReturn) o
 		}
 	}
 	
+	//whatever the server's scrubber turned up
+	for _, id := range args.BadChunks {
+		if c, ok := chunks[id]; ok && c.heldBy(server) {
+			c.lostReplica(server, true)
+		}
+	}
+	for _, id := range args.MissingChunks {
+		if c, ok := chunks[id]; ok && c.heldBy(server) {
+			c.lostReplica(server, false)
+		}
+	}
+
 	info.ChunksToRemove = server.evictedChunks
 	
 	server.evictedChunks = new(vector.Vector)
 
-	heartbeatMonitors[args.ChunkServerID] <- time.Nanoseconds()
+	//the monitor may be waiting on chunkLock to remove the server, so the
+	//beat goes without the lock and is dropped if nobody takes it
+	beats := heartbeatMonitors[args.ChunkServerID]
+	chunkLock.Unlock()
+
+	select {
+	case beats <- time.Nanoseconds():
+	default:
+	}
 
 	return nil
 }
@@ -371,7 +685,12 @@ func (s *server) monitorServerBeats(beats chan int64) int {
 		case <-beats:
 			continue
 		case <-t.C:
-			RemoveServer(s)
+			chunkLock.Lock()
+			//it may have been born again as a new server since
+			if servers[s.id] == s {
+				RemoveServer(s)
+			}
+			chunkLock.Unlock()
 			return -1
 		}
 	}
@@ -400,10 +719,11 @@ func AddServer(servAddr net.TCPAddr, capacity uint64) *server {
 	nextChunkServerID += 1
 	s.addr = servAddr
 	s.capacity = capacity
+	s.draining = drainingAddrs[str]
 	s.chunks = new(vector.Vector)
 	s.evictedChunks = new(vector.Vector)
 
-	heartbeatMonitors[s.id] = make(chan int64)
+	heartbeatMonitors[s.id] = make(chan int64, 1)
 	heap.Push(sHeap, s)
 	servers[s.id] = s
 	addrToServerMap[str] = s
@@ -423,14 +743,14 @@ func populateServer(serv *server) ([]sfs.ReplicateChunkArgs) {
 	log.Printf("master: PopulateServer: populating %s\n", str)
 	log.Printf("master: PopulateServer: server heap state:\n%s\n", sHeap.printPresent())
 
-	if len(chunks) == 0 {
+	if len(chunks) == 0 || serv.full() || serv.draining {
 		return nil
 	}
 	
 	thisVec := new(vector.Vector)
 	for _, chunk := range chunks {
 		//log.Printf("master: PopulateServer: examining chunk %+v, nservers %d\n", *chunk, chunk.servers.Len())
-		if chunk.servers.Len() < sfs.NREPLICAS {
+		if chunk.servers.Len() < chunk.replicaTarget() && !chunk.heldBy(serv) && chunk.spreadsTo(serv) {
 
 			//populate chunk location list
 			chunklist := make([]net.TCPAddr, chunk.servers.Len())
@@ -439,7 +759,7 @@ func populateServer(serv *server) ([]sfs.ReplicateChunkArgs) {
 			}
 
 			//send rpc call off
-			thisVec.Push(sfs.ReplicateChunkArgs{chunk.chunkID, chunklist})
+			thisVec.Push(sfs.ReplicateChunkArgs{chunk.chunkID, chunklist, chunk.version, chunk.hash})
 		}
 	}
 	
@@ -453,6 +773,8 @@ func populateServer(serv *server) ([]sfs.ReplicateChunkArgs) {
 	return thisSlice
 }
 
+// RemoveServer forgets a dead server and queues its chunks for
+// re-replication. The caller holds chunkLock.
 func RemoveServer(serv *server) os.Error {
 	log.Printf("master: RemoveServer: server heap pre removal:\n%s\n", sHeap.printPresent())
 
@@ -469,117 +791,18 @@ func RemoveServer(serv *server) os.Error {
 	str := fmt.Sprintf("%s:%d", serv.addr.IP.String(), serv.addr.Port)
 	
 	servers[serv.id] = &server{}, false
-	addrToServerMap[str] = &server{}, false
+	heartbeatMonitors[serv.id] = nil, false
+	if addrToServerMap[str] == serv {
+		addrToServerMap[str] = &server{}, false
+	}
+	sfs.Conns.Forget(str)
 
 	str1 := fmt.Sprintf("removing server %s:%d", serv.addr.IP.String(), serv.addr.Port)
 	log.Printf("master: RemoveServer: begin %s\n", str1)
 	
-	network_size := float64(sHeap.vec.Len())
-	if network_size <= 0 { 
-		return nil
-	}
-	//chunk_size := serv.chunks.Len()
-	rep_factor := .9
-
-	//map the size of the network to some fraction of that size to replicate to
-	if network_size < 10 {
-		rep_factor = .5
-	} else {
-		rep_factor = .3
-	}
-
-	rep_size := int(math.Fmin(math.Ceil(rep_factor * network_size), network_size))
-
-	//for each chunk in the server, make a replication call
-	sanity_threshhold1 := 4
-	sanity_threshhold2 := 10
-	sanity_count := 0
-	
-	targetServerMap := make(map[string](bool))
-	
-ChunkReplicate:	for cnt := 0; cnt < serv.chunks.Len(); {
-		
-		var index int
-		if sanity_count > sanity_threshhold1 {
-		    index = rand.Intn(rep_size)
-		}else{
-		    index = rand.Intn(sHeap.vec.Len())
-		}
-
-		otherserver := sHeap.vec.At(index).(*server)
-		chunk := serv.chunks.At(cnt).(*chunk)
-		
-		str := fmt.Sprintf("%s:%d", otherserver.addr.IP.String(), otherserver.addr.Port)
-		
-		sCnt := chunk.servers.Len()
-		
-		if sCnt >= len(servers) {
-			log.Printf("master: RemoveServer: abort replication req for chunk %d; all active servers already hold replicas\n", chunk.chunkID)
-			cnt++
-			sanity_count = 0
-			targetServerMap = make(map[string](bool))
-		}
-		
-		if targetServerMap[str] == true {
-			continue
-		}
-		
-		for ijk := 0; ijk < sCnt; ijk++ {
-			if chunk.servers.At(ijk).(*server) == otherserver {
-				targetServerMap[str] = true
-				
-				if len(targetServerMap) >= len(servers){
-					log.Printf("master: RemoveServer: abort replication req for chunk %d; all active servers already hold replicas\n", chunk.chunkID)
-					cnt++
-					sanity_count = 0
-					targetServerMap = make(map[string](bool))
-				}
-				
-				continue ChunkReplicate
-			}
-		}
-		
-		log.Printf("master: RemoveServer: attempting to replicate chunk %d to server %s\n", chunk.chunkID, str)
-
-		//log.Printf("master: RemoveServer: dialing %s to replicate\n", str)
-
-		client, err := rpc.Dial("tcp", str)
-
-		if err != nil {
-			log.Printf("master: RemoveServer: unable to dial %s\n", str)
-			sanity_count = sanity_count + 1
-			continue
-		} else {
-			log.Printf("master: RemoveServer: dial %s succeeded\n", str)
-		}
-
-		if sanity_count > sanity_threshhold2 {
-			log.Printf("master: RemoveServer: tried %d times to dial servers to replicate, and gave up!!!!\n", sanity_threshhold2)
-			break
-			
-		}
-
-		//populate chunk location vector
-		chunklist := make([]net.TCPAddr, chunk.servers.Len())
-		for cnt1 := 0; cnt1 < chunk.servers.Len(); cnt1++ {
-			chunklist[cnt1] = chunk.servers.At(cnt1).(*server).addr
-		}
-
-		//send rpc call off
-		args := &sfs.ReplicateChunkArgs{chunk.chunkID, chunklist}
-		reply := new(sfs.ReplicateChunkReturn)
-		log.Printf("master: RemoveServer: issuing replication req to %s\n", str)
-		err = client.Call("Server.ReplicateChunk", args, reply)
-		if err != nil {
-			log.Printf("master: RemoveServer: unable to call %s\n", str)
-			client.Close()
-			continue
-		}
-		//log.Printf("%s", reply)
-		client.Close()
-		cnt++
-		sanity_count = 0
-		targetServerMap = make(map[string](bool))
+	//the heap handler already struck serv off each chunk's server list
+	for cnt := 0; cnt < serv.chunks.Len(); cnt++ {
+		enqueueReplication(serv.chunks.At(cnt).(*chunk))
 	}
 
 	log.Printf("master: RemoveServer: finished %s\n", str1)
@@ -595,14 +818,17 @@ ChunkReplicate:	for cnt := 0; cnt < serv.chunks.Len(); {
 	return nil
 }
 
-func OpenFile(name string, create bool) (i *inode, newFile bool, err os.Error) {
+func OpenFile(name string, create bool, owner string, group string) (i *inode, newFile bool, err os.Error) {
 	err = nil
 
 	i, exists, error := QueryFile(name)
 
 	if !exists && create {
 		log.Printf("OpenFile: file %s does not exist\n", name)
-		i, err = AddFile(name)
+		i, err = AddFile(name, owner, group)
+		if err != nil {
+			return nil, false, err
+		}
 	} else if !exists && !create {
 		return nil, true, error
 	}
@@ -612,47 +838,53 @@ func OpenFile(name string, create bool) (i *inode, newFile bool, err os.Error) {
 	return i, newFile, nil
 }
 
-func AddFile(name string) (i *inode, err os.Error) {
+func AddFile(name string, owner string, group string) (i *inode, err os.Error) {
 	i = new(inode)
 
 	log.Printf("AddFile: nextChunk %d, len(servers) %d\n", nextChunk, sHeap.Len())
 
 	i.size = 0
+	i.permissions = sfs.DEFAULT_FILE_MODE
+	i.owner = owner
+	i.group = group
+	i.ctime = now()
+	i.mtime = i.ctime
+	i.atime = i.ctime
+	i.version = nextVersion()
 	//i.addr = *(servers.At(int(nextChunk) % servers.Len()).(*net.TCPAddr))
 	//i.addr = servers[0]
 
 	i.chunks = new(vector.Vector)
 
+	dir, _ := path.Split(name)
+	i.chunkSize = dirChunkSize(dir)
+
 	//i.AddChunk()
 
-	err = t.AddFile(name, i) // trie insert
+	err = addFileNode(name, i)
 	
 	if err != nil {
 		return nil, err
 	}
-	
-	log.Printf("AddFile: %d nodes in trie\n", t.Size())
 
 	return i, nil
 }
 
 func QueryFile(name string) (i *inode, fileExists bool, err os.Error) {
-	inter, exists, error := t.QueryFile(name)
+	i, err = lookupFile(name)
 
-	if !exists {
+	if err != nil {
 		log.Printf("QueryFile: file %s does not exist\n", name)
-		return nil, exists, error
+		return nil, false, err
 	}
 
-	log.Printf("QueryFile: %d nodes in trie\n", t.Size())
-
-	return inter.(*inode), exists, nil
+	return i, true, nil
 }
 
 func DeleteFile(name string) (err os.Error) {
 	inode, exists ,_:= QueryFile(name)
 	if exists {
-		err := t.DeleteFile(name)
+		_, err := removeFileNode(name)
 		
 		if err != nil {
 			log.Printf("Delete: file %s does not exist\n", name)
@@ -668,8 +900,6 @@ func DeleteFile(name string) (err os.Error) {
 		}
 	}
 
-	log.Printf("DeleteFile: %d nodes in trie\n", t.Size())
-
 	return nil
 }
 
@@ -722,12 +952,14 @@ func (i *inode) MapChunk(offset int, newChunk *chunk) (chunkID uint64, err os.Er
 	if offset < i.chunks.Len() {
 		oldID = i.chunks.At(offset).(*chunk).chunkID
 		
+		//take the new reference first in case old and new are the same chunk
+		newChunk.refCt++
+		
 		c, ok := chunks[oldID]
 		
 		if ok {
 			c.unmapChunk()
 		}
-		newChunk.refCt++		
 		i.chunks.Set(offset, newChunk)
 	} else if offset == i.chunks.Len() {
 		newChunk.refCt++
@@ -759,21 +991,15 @@ func (i *inode) MapChunk(offset int, newChunk *chunk) (chunkID uint64, err os.Er
 func (c *chunk) unmapChunk() (err os.Error){
 	c.refCt--
 	
-	if c.refCt == 0 {
+	//still mapped into some other file
+	if c.refCt != 0 {
 		return nil
 	}
 	
-	cnt := c.servers.Len()	
-	for j := 0; j < cnt; j++ {
-		c.servers.At(j).(*server).evictedChunks.Push(c.chunkID)
-		
-		cnt2 := c.servers.At(j).(*server).chunks.Len()
-		for k := 0; k < cnt2; k++ {
-			if c.servers.At(j).(*server).chunks.At(k).(*chunk) == c {
-				c.servers.At(j).(*server).chunks.Delete(k)
-				cnt2--
-			}
-		}
+	for c.servers.Len() > 0 {
+		s := c.servers.At(0).(*server)
+		c.dropServer(s)
+		s.evictedChunks.Push(c.chunkID)
 	}
 	
 	chunks[c.chunkID] = &chunk{}, false
@@ -795,6 +1021,89 @@ func (c *chunk) AssociateServer(s *server) os.Error {
 	return nil
 } 
 
+func (c *chunk) heldBy(s *server) bool {
+	cnt := c.servers.Len()
+	for i := 0; i < cnt; i++ {
+		if c.servers.At(i).(*server) == s {
+			return true
+		}
+	}
+	return false
+}
+
+// dropServer forgets that s holds a copy of c.
+func (c *chunk) dropServer(s *server) {
+	for j := 0; j < c.servers.Len(); j++ {
+		if c.servers.At(j).(*server) == s {
+			c.servers.Delete(j)
+			break
+		}
+	}
+
+	for k := 0; k < s.chunks.Len(); k++ {
+		if s.chunks.At(k).(*chunk) == c {
+			s.chunks.Delete(k)
+			break
+		}
+	}
+}
+
+// checkReplica decides whether the copy of c that s reports, at version,
+// is current. Only the master hands out versions, so an older copy is
+// stale and a newer one can only be corrupt; either way it is forgotten
+// and evicted.
+func (c *chunk) checkReplica(s *server, version uint64) bool {
+	if version < c.version {
+		log.Printf("master: checkReplica: chunk %d on %s is stale (version %d, want %d)\n", c.chunkID, s.addr.String(), version, c.version)
+	} else if version > c.version {
+		log.Printf("master: checkReplica: chunk %d on %s is at version %d, ahead of %d; treating it as corrupt\n", c.chunkID, s.addr.String(), version, c.version)
+	} else {
+		return true
+	}
+
+	c.dropServer(s)
+	s.evictedChunks.Push(c.chunkID)
+	return false
+}
+
+// setAllocated records the version a chunk ID was handed out with, or
+// forgets it once the chunk is mapped and has a version of its own.
+func setAllocated(id uint64, version uint64, handedOut bool) {
+	versionLock.Lock()
+	defer versionLock.Unlock()
+
+	allocated[id] = version, handedOut
+}
+
+// chunkVersion is the version the master expects copies of a chunk to
+// be at.
+func chunkVersion(id uint64) (uint64, bool) {
+	if c, ok := chunks[id]; ok {
+		return c.version, true
+	}
+
+	versionLock.Lock()
+	defer versionLock.Unlock()
+
+	version, ok := allocated[id]
+	return version, ok
+}
+
+// expireAllocated forgets chunk IDs handed out more than ALLOC_EXPIRY
+// before now that no file has mapped: their writes failed or were given
+// up. Versions come from the clock, so a version's age is the
+// allocation's. The caller holds chunkLock, which mapping is done under.
+func expireAllocated(now int64) {
+	versionLock.Lock()
+	defer versionLock.Unlock()
+
+	for id, version := range allocated {
+		if int64(version) < now-ALLOC_EXPIRY {
+			allocated[id] = 0, false
+		}
+	}
+}
+
 func (s *server) AssociateChunk(c *chunk) os.Error {
 	cnt := s.chunks.Len()
 	for i := 0; i < cnt; i++ {
@@ -825,21 +1134,67 @@ func AssociateChunkAndServer(c *chunk, s *server) os.Error {
 }
 
 
-func FindMissingChunkReplicas() (ret uint64) {
-	for cID, _ := range chunks {
-		if chunks[cID].servers.Len() < sfs.NREPLICAS {
-			ret += 1
-			replicateChunk(cID)
+// evicting reports whether s has been told to throw away its copy of cID.
+func (s *server) evicting(cID uint64) bool {
+	for i := 0; i < s.evictedChunks.Len(); i++ {
+		if s.evictedChunks.At(i).(uint64) == cID {
+			return true
 		}
 	}
+	return false
+}
+
+func (m *Master) ReportBadChunk(args *sfs.ReportBadChunkArgs, ret *sfs.ReportBadChunkReturn) os.Error {
+	if err := primaryOnly(); err != nil {
+		return err
+	}
+
+	ret.Status = sfs.FAIL
+
+	chunkLock.Lock()
+	defer chunkLock.Unlock()
+
+	c, ok := chunks[args.ChunkID]
+	if !ok {
+		return os.NewError("no such chunk")
+	}
+
+	str := fmt.Sprintf("%s:%d", args.Server.IP.String(), args.Server.Port)
+	s, ok := addrToServerMap[str]
+	if !ok || !c.heldBy(s) {
+		//already dealt with, or never a replica
+		ret.Status = sfs.SUCCESS
+		return nil
+	}
+
+	err := c.lostReplica(s, true)
+	if err != nil {
+		return err
+	}
 
-	return ret
+	ret.Status = sfs.SUCCESS
+	return nil
 }
 
-func replicateChunk(cID uint64) (err os.Error) {
-	//var m Master
+// lostReplica forgets the copy of c on s, evicting it if it is still on
+// disk but corrupt, and queues the chunk for re-replication. The last copy
+// of a chunk is kept even if it is corrupt.
+func (c *chunk) lostReplica(s *server, corrupt bool) os.Error {
+	str := fmt.Sprintf("%s:%d", s.addr.IP.String(), s.addr.Port)
+
+	if corrupt && c.servers.Len() == 1 {
+		log.Printf("master: lostReplica: chunk %d on %s is corrupt but is the last copy\n", c.chunkID, str)
+		return os.NewError("no other copy of the chunk")
+	}
+
+	log.Printf("master: lostReplica: dropping chunk %d from %s (corrupt %v)\n", c.chunkID, str, corrupt)
 
-	//m.WriteReplicationReq(chunks[cID])
+	c.dropServer(s)
+	if corrupt {
+		s.evictedChunks.Push(c.chunkID)
+	}
+
+	enqueueReplication(c)
 
 	return nil
 }
@@ -853,32 +1208,31 @@ func sigHandler() {
 		if sig.String() == "SIGTERM: termination" || sig.String() == "SIGINT: interrupt" {
 			//log.Printf("\n\nchunk map: %+v \n\nhashToChunks map: %+v\n\n", chunks, hashToChunkMap)
 			log.Printf("\n\nchunk map len: %d \n\nhashToChunks map len: %d\n\n", len(chunks), len(hashToChunkMap))
-			DumpTrie()
+			DumpNamespace()
+			if oplog != nil {
+				oplog.lock.Lock()
+				err := oplog.checkpoint()
+				if err != nil {
+					log.Printf("checkpoint on exit failed: %s\n", err.String())
+				}
+			}
 			os.Exit(1337)
 		} else if sig.String() == "SIGHUP: terminal line hangup" {
 			runtime.GC()
 			log.Printf("Garbage collection complete!")
-			DumpTrie()
+			DumpNamespace()
 		}
 
+		chunkLock.Lock()
 		for s := range servers {
 			fmt.Printf("%+v\n", s)
 		}
+		chunkLock.Unlock()
 	}
 }
 
-func DumpTrie(){
-	dump := t.Members()
-	
-	cnt := dump.Len()
-	for i := 0; i < cnt; i++ {
-		log.Printf("dumpTrie: %d: %s\n", i, dump.At(i))
-	}
-	//log.Printf("dumpTrie: DOT file follows\n******\n%s\n******\n", t.GetDotString())
-}
-
 func init() {
-	t = trie.NewTrie()
+	resetNamespace()
 
 	sHeap = new(serverHeap)
 	sHeap.vec = new(vector.Vector)
@@ -887,16 +1241,12 @@ func init() {
 	addrToServerMap = make(map[string](*server))
 	heartbeatMonitors = make(map[uint64](chan int64))
 	hashToChunkMap = make(map[string](*chunk))
+	leases = make(map[uint64](*lease))
 	//	sMap = make(map[net.TCPAddr](*server))
 	heap.Init(sHeap)
 	sHeap.serverChan = make(chan *heapCommand)
 	go sHeap.Handler()
+	go sHeap.reheap()
 	go sigHandler()
-
-	t.AddDir("/")
-
-	//missingCh := make(chan uint64)
-
-	//go FindMissingChunkReplicas(missingCh)
-	//go QueueReplication(missingCh)
+	go expireLeases()
 }
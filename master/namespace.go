@@ -0,0 +1,464 @@
+package master
+
+import (
+	"os"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"../include/sfs"
+)
+
+// dirNode is a directory inode. Children are found by name in hashed maps,
+// so resolving a path costs one map lookup per component.
+type dirNode struct {
+	name   string
+	parent *dirNode // nil at the root
+	dirs   map[string](*dirNode)
+	files  map[string](*inode)
+	layout *layout // chunk size and replica overrides, nil if none
+
+	permissions uint64
+	owner       string
+	group       string
+	ctime       int64  // attributes last changed
+	mtime       int64  // entries last added or removed
+	version     uint64 // changes whenever the listing or attributes do
+
+	usedBytes uint64 // logical bytes in files in this subtree
+	usedFiles uint64
+	maxBytes  uint64 // quota on the subtree, 0 for none
+	maxFiles  uint64
+}
+
+var nsLock sync.Mutex
+var root *dirNode
+
+func newDirNode(name string, parent *dirNode) *dirNode {
+	d := new(dirNode)
+	d.name = name
+	d.parent = parent
+	d.dirs = make(map[string](*dirNode))
+	d.files = make(map[string](*inode))
+	d.permissions = sfs.DEFAULT_DIR_MODE
+	d.ctime = now()
+	d.mtime = d.ctime
+	d.version = nextVersion()
+	return d
+}
+
+// resetNamespace leaves nothing but an empty root directory.
+func resetNamespace() {
+	nsLock.Lock()
+	defer nsLock.Unlock()
+
+	//anyone may make files and directories at the top until told otherwise
+	root = newDirNode("", nil)
+	root.permissions = 0777
+
+	resetQuotas()
+}
+
+// cleanPath puts a client supplied path in canonical form: absolute, no
+// "." or ".." components, no doubled or trailing slashes.
+func cleanPath(p string) (string, os.Error) {
+	if len(p) == 0 {
+		return "", os.NewError("empty path")
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	return path.Clean(p), nil
+}
+
+// splitPath cleans p and breaks it into its components; the root has none.
+func splitPath(p string) ([]string, os.Error) {
+	p, err := cleanPath(p)
+	if err != nil {
+		return nil, err
+	}
+	if p == "/" {
+		return nil, nil
+	}
+	return strings.Split(p[1:], "/", -1), nil
+}
+
+// walk follows the components in parts down from the root. The caller
+// holds nsLock.
+func walk(parts []string) (*dirNode, os.Error) {
+	d := root
+	for _, name := range parts {
+		next, ok := d.dirs[name]
+		if !ok {
+			if _, isFile := d.files[name]; isFile {
+				return nil, os.NewError(name + " is not a directory")
+			}
+			return nil, os.NewError("no such directory")
+		}
+		d = next
+	}
+	return d, nil
+}
+
+// lookupDir resolves p to its directory inode.
+func lookupDir(p string) (*dirNode, os.Error) {
+	parts, err := splitPath(p)
+	if err != nil {
+		return nil, err
+	}
+
+	nsLock.Lock()
+	defer nsLock.Unlock()
+
+	return walk(parts)
+}
+
+// lookupParent resolves the directory holding p and returns it along with
+// the last component of p. The caller holds nsLock.
+func lookupParent(p string) (*dirNode, string, os.Error) {
+	parts, err := splitPath(p)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(parts) == 0 {
+		return nil, "", os.NewError("the root directory has no parent")
+	}
+
+	d, err := walk(parts[:len(parts)-1])
+	if err != nil {
+		return nil, "", err
+	}
+	return d, parts[len(parts)-1], nil
+}
+
+// path rebuilds the full path of d, with a trailing slash.
+func (d *dirNode) path() string {
+	if d.parent == nil {
+		return "/"
+	}
+	return d.parent.path() + d.name + "/"
+}
+
+// holds reports whether d is sub or one of its ancestors.
+func (d *dirNode) holds(sub *dirNode) bool {
+	for ; sub != nil; sub = sub.parent {
+		if sub == d {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *dirNode) empty() bool {
+	return len(d.dirs) == 0 && len(d.files) == 0
+}
+
+// lookupFile returns the inode of the file at p.
+func lookupFile(p string) (*inode, os.Error) {
+	nsLock.Lock()
+	defer nsLock.Unlock()
+
+	d, name, err := lookupParent(p)
+	if err != nil {
+		return nil, err
+	}
+
+	i, ok := d.files[name]
+	if !ok {
+		return nil, os.NewError("file does not exist")
+	}
+	return i, nil
+}
+
+// addFileNode links i into the namespace at p.
+func addFileNode(p string, i *inode) os.Error {
+	nsLock.Lock()
+	defer nsLock.Unlock()
+
+	d, name, err := lookupParent(p)
+	if err != nil {
+		return err
+	}
+	if _, ok := d.files[name]; ok {
+		return os.NewError("file already exists")
+	}
+	if _, ok := d.dirs[name]; ok {
+		return os.NewError("a directory of that name already exists")
+	}
+
+	d.files[name] = i
+	d.mtime = now()
+	d.version = nextVersion()
+	d.charge(int64(i.size), 1)
+	chargeUser(i.owner, int64(i.size), 1)
+	return nil
+}
+
+// removeFileNode unlinks the file at p and returns its inode.
+func removeFileNode(p string) (*inode, os.Error) {
+	nsLock.Lock()
+	defer nsLock.Unlock()
+
+	d, name, err := lookupParent(p)
+	if err != nil {
+		return nil, err
+	}
+
+	i, ok := d.files[name]
+	if !ok {
+		return nil, os.NewError("file does not exist")
+	}
+
+	d.files[name] = nil, false
+	d.mtime = now()
+	d.version = nextVersion()
+	d.charge(-int64(i.size), -1)
+	chargeUser(i.owner, -int64(i.size), -1)
+	return i, nil
+}
+
+// makeDir creates the directory p, owned by owner and group; its parent
+// has to exist already.
+func makeDir(p string, owner string, group string) os.Error {
+	nsLock.Lock()
+	defer nsLock.Unlock()
+
+	d, name, err := lookupParent(p)
+	if err != nil {
+		return err
+	}
+	if _, ok := d.dirs[name]; ok {
+		return os.NewError("directory already exists")
+	}
+	if _, ok := d.files[name]; ok {
+		return os.NewError("a file of that name already exists")
+	}
+
+	dir := newDirNode(name, d)
+	dir.owner = owner
+	dir.group = group
+	d.dirs[name] = dir
+	d.mtime = now()
+	d.version = nextVersion()
+	return nil
+}
+
+// removeDir removes the directory p, which has to be empty unless
+// recursive is set. The whole subtree is unlinked in one step, so a file
+// created concurrently either lands before and goes with it or finds its
+// directory gone. The files that were in it are returned so the caller
+// can let go of their chunks.
+func removeDir(p string, recursive bool) ([]*inode, os.Error) {
+	nsLock.Lock()
+	defer nsLock.Unlock()
+
+	d, name, err := lookupParent(p)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, ok := d.dirs[name]
+	if !ok {
+		return nil, os.NewError("no such directory")
+	}
+	if !dir.empty() && !recursive {
+		return nil, os.NewError("directory is not empty")
+	}
+
+	d.dirs[name] = nil, false
+	d.mtime = now()
+	d.version = nextVersion()
+	d.charge(-int64(dir.usedBytes), -int64(dir.usedFiles))
+
+	var files []*inode
+	var gather func(d *dirNode)
+	gather = func(d *dirNode) {
+		for _, file := range d.files {
+			files = append(files, file)
+		}
+		for _, sub := range d.dirs {
+			gather(sub)
+		}
+	}
+	gather(dir)
+
+	for _, file := range files {
+		chargeUser(file.owner, -int64(file.size), -1)
+	}
+
+	return files, nil
+}
+
+// rename moves the file or directory at from to to in one step. An
+// existing file at to is replaced, and its inode returned so the caller
+// can let go of its chunks, only if overwrite is set; an existing
+// directory at to is replaced only if it is empty. A directory can't be
+// moved into its own subtree, and nothing can be moved where it would take
+// a directory past its quota.
+func rename(from string, to string, overwrite bool) (replaced *inode, err os.Error) {
+	nsLock.Lock()
+	defer nsLock.Unlock()
+
+	src, srcName, err := lookupParent(from)
+	if err != nil {
+		return nil, err
+	}
+	dst, dstName, err := lookupParent(to)
+	if err != nil {
+		return nil, err
+	}
+
+	if src == dst && srcName == dstName {
+		return nil, nil
+	}
+
+	if file, ok := src.files[srcName]; ok {
+		if _, ok := dst.dirs[dstName]; ok {
+			return nil, os.NewError("cannot replace a directory with a file")
+		}
+		old, exists := dst.files[dstName]
+		if exists && !overwrite {
+			return nil, os.NewError("destination already exists")
+		}
+		var freedBytes, freedFiles uint64
+		if exists {
+			freedBytes, freedFiles = old.size, 1
+		}
+		if !dst.roomFor(src, file.size, 1, freedBytes, freedFiles) {
+			return nil, errQuota
+		}
+
+		src.files[srcName] = nil, false
+		src.charge(-int64(file.size), -1)
+		if exists {
+			dst.charge(-int64(old.size), -1)
+			chargeUser(old.owner, -int64(old.size), -1)
+		}
+		dst.files[dstName] = file
+		dst.charge(int64(file.size), 1)
+		file.ctime = now()
+		src.mtime, dst.mtime = file.ctime, file.ctime
+		file.version = nextVersion()
+		src.version, dst.version = file.version, file.version
+		return old, nil
+	}
+
+	dir, ok := src.dirs[srcName]
+	if !ok {
+		return nil, os.NewError("no such file or directory")
+	}
+	if dir.holds(dst) {
+		return nil, os.NewError("cannot move a directory into itself")
+	}
+	if _, ok := dst.files[dstName]; ok {
+		return nil, os.NewError("cannot replace a file with a directory")
+	}
+	if old, ok := dst.dirs[dstName]; ok {
+		if !overwrite {
+			return nil, os.NewError("destination already exists")
+		}
+		if !old.empty() {
+			return nil, os.NewError("destination directory is not empty")
+		}
+	}
+	if !dst.roomFor(src, dir.usedBytes, dir.usedFiles, 0, 0) {
+		return nil, errQuota
+	}
+
+	src.dirs[srcName] = nil, false
+	src.charge(-int64(dir.usedBytes), -int64(dir.usedFiles))
+	dst.charge(int64(dir.usedBytes), int64(dir.usedFiles))
+	dir.name = dstName
+	dir.parent = dst
+	dst.dirs[dstName] = dir
+	dir.ctime = now()
+	src.mtime, dst.mtime = dir.ctime, dir.ctime
+	dir.version = nextVersion()
+	src.version, dst.version = dir.version, dir.version
+	return nil, nil
+}
+
+// listDir returns the names in directory p, subdirectories first and
+// marked with a trailing slash, each group sorted, along with the
+// directory's version.
+func listDir(p string) ([]string, uint64, os.Error) {
+	parts, err := splitPath(p)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	nsLock.Lock()
+	defer nsLock.Unlock()
+
+	d, err := walk(parts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	dirs := make([]string, 0, len(d.dirs))
+	for name := range d.dirs {
+		dirs = append(dirs, name+"/")
+	}
+	files := make([]string, 0, len(d.files))
+	for name := range d.files {
+		files = append(files, name)
+	}
+	sort.SortStrings(dirs)
+	sort.SortStrings(files)
+
+	return append(dirs, files...), d.version, nil
+}
+
+type namedFile struct {
+	name string
+	file *inode
+}
+
+// walkFiles calls fn on every file in the directory prefix and below. The
+// files are gathered first, so fn may look things up in the namespace.
+func walkFiles(prefix string, fn func(name string, file *inode)) {
+	var found []namedFile
+
+	walkDirs(prefix, func(dir string, d *dirNode) {
+		for name, file := range d.files {
+			found = append(found, namedFile{dir + name, file})
+		}
+	})
+
+	for _, f := range found {
+		fn(f.name, f.file)
+	}
+}
+
+// walkDirs calls fn, under nsLock, on prefix and every directory below it,
+// parents before children.
+func walkDirs(prefix string, fn func(dir string, d *dirNode)) {
+	parts, err := splitPath(prefix)
+	if err != nil {
+		return
+	}
+
+	nsLock.Lock()
+	defer nsLock.Unlock()
+
+	d, err := walk(parts)
+	if err != nil {
+		return
+	}
+
+	var visit func(dir string, d *dirNode)
+	visit = func(dir string, d *dirNode) {
+		fn(dir, d)
+		for name, sub := range d.dirs {
+			visit(dir+name+"/", sub)
+		}
+	}
+	visit(d.path(), d)
+}
+
+func DumpNamespace() {
+	walkDirs("/", func(dir string, d *dirNode) {
+		log.Printf("dumpNamespace: %s (%d dirs, %d files)\n", dir, len(d.dirs), len(d.files))
+	})
+}
@@ -0,0 +1,724 @@
+package master
+
+import (
+	"os"
+	"io"
+	"io/ioutil"
+	"log"
+	"gob"
+	"bufio"
+	"bytes"
+	"sync"
+	"time"
+	"path"
+	"strconv"
+	"encoding/binary"
+	"container/vector"
+	"../include/sfs"
+)
+
+//operations recorded in the log
+const (
+	opMakeDir = iota
+	opRemoveDir
+	opCreateFile
+	opDeleteFile
+	opRemoveFile
+	opMapChunk
+	opAllocChunk
+	opSetLayout
+	opRename
+	opChmod
+	opChown
+	opSetQuota
+	opDrain
+)
+
+const CHECKPOINT_EVERY = 1024          // log entries between checkpoints
+const CHECKPOINT_WAIT = 60 * 1000000000 // 60 seconds
+
+const checkpointName = "checkpoint"
+const logName = "oplog"
+
+type logEntry struct {
+	Seq     uint64
+	Time    int64 // when the op was committed
+	Op      int
+	Name    string
+	Offset  int
+	ChunkID uint64
+	Size    uint64
+	Hash    []byte
+
+	ChunkSize uint64
+	Replicas  int
+	Clear     bool
+	Version   uint64
+
+	NewName   string
+	Overwrite bool
+	Recursive bool
+
+	Owner string
+	Group string
+	Mode  uint64
+	Files uint64
+}
+
+type fileRecord struct {
+	Name      string
+	Size      uint64
+	Chunks    []uint64
+	ChunkSize uint64
+	Replicas  int
+	Owner     string
+	Group     string
+	Mode      uint64
+	Ctime     int64
+	Mtime     int64
+	Atime     int64
+}
+
+type dirRecord struct {
+	Name      string
+	ChunkSize uint64
+	Replicas  int
+	Owner     string
+	Group     string
+	Mode      uint64
+	Ctime     int64
+	Mtime     int64
+
+	QuotaBytes uint64
+	QuotaFiles uint64
+}
+
+type quotaRecord struct {
+	User  string
+	Bytes uint64
+	Files uint64
+}
+
+type chunkRecord struct {
+	ChunkID uint64
+	Size    uint64
+	Hash    []byte
+	Version uint64
+}
+
+type checkpoint struct {
+	Seq       uint64 // last log entry folded into this checkpoint
+	NextChunk uint64
+	Dirs      []string
+	Layouts   []dirRecord // layout and attributes of each directory
+	Files     []fileRecord
+	Chunks    []chunkRecord
+	Quotas    []quotaRecord // users with a quota set
+	Allocated []chunkRecord // chunks handed out that no file has mapped yet
+	Draining  []string      // addresses of chunk servers being decommissioned
+}
+
+type opLog struct {
+	lock    sync.Mutex
+	dir     string
+	file    *os.File
+	seq     uint64
+	base    uint64 // seq folded into the checkpoint on disk
+	pending int
+}
+
+var oplog *opLog
+
+// opTime is the time stamped on the entry being applied, so that an entry
+// replayed later gives files the same times it did when it was committed.
+var opTime int64
+
+// now is the time to record for the change being made.
+func now() int64 {
+	if opTime != 0 {
+		return opTime
+	}
+	return time.Nanoseconds()
+}
+
+// Recover loads the latest checkpoint from dir, replays the log written
+// after it and opens the log for appending. It has to run before the
+// master accepts any RPCs.
+func Recover(dir string) os.Error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	l := new(opLog)
+	l.dir = dir
+
+	cp, err := readCheckpoint(path.Join(dir, checkpointName))
+	if err != nil {
+		return err
+	}
+	if cp != nil {
+		err = restore(cp)
+		if err != nil {
+			return err
+		}
+		l.seq = cp.Seq
+		l.base = cp.Seq
+		log.Printf("master: Recover: loaded checkpoint at seq %d (%d dirs, %d files, %d chunks)\n", cp.Seq, len(cp.Dirs), len(cp.Files), len(cp.Chunks))
+	}
+
+	l.file, err = os.Open(path.Join(dir, logName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	n, end, err := l.replay()
+	if err != nil {
+		return err
+	}
+
+	//drop a torn record left behind by a crash mid-append
+	err = l.file.Truncate(end)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Seek(end, 0)
+	if err != nil {
+		return err
+	}
+	l.pending = n
+
+	log.Printf("master: Recover: replayed %d log entries, now at seq %d, nextChunk %d\n", n, l.seq, nextChunk)
+
+	oplog = l
+	go l.checkpointer()
+
+	return nil
+}
+
+// commit runs apply and, only if it succeeds, appends e to the log and
+// forces it to disk, all while holding the log lock. Every change to the
+// namespace goes through here, so apply can check what it depends on and
+// know nothing moves under it, and an op that fails never reaches the log
+// to be replayed at each recovery. The caller answers its client only once
+// commit returns, by which time the op is durable. An op that was applied
+// but can't be logged leaves memory ahead of the log, so the master stops
+// rather than carry on from state it couldn't recover.
+func commit(e *logEntry, apply func() os.Error) os.Error {
+	if oplog == nil {
+		chunkLock.Lock()
+		defer chunkLock.Unlock()
+		return apply()
+	}
+
+	oplog.lock.Lock()
+	defer oplog.lock.Unlock()
+
+	e.Time = time.Nanoseconds()
+	opTime = e.Time
+	chunkLock.Lock()
+	err := apply()
+	chunkLock.Unlock()
+	opTime = 0
+	if err != nil {
+		return err
+	}
+
+	err = oplog.append(e)
+	if err != nil {
+		log.Printf("master: commit: unable to log op %d on %s: %s\n", e.Op, e.Name, err.String())
+		log.Fatal("master: the log is behind memory; stopping")
+	}
+
+	if oplog.pending >= CHECKPOINT_EVERY {
+		cerr := oplog.checkpoint()
+		if cerr != nil {
+			log.Printf("master: commit: checkpoint failed: %s\n", cerr.String())
+		}
+	}
+
+	return nil
+}
+
+// allocChunkID hands out the next chunk ID and the version its copies are
+// to be written at, logging them first so a restarted master never hands
+// the same ID out twice and still knows the version when the chunk is
+// mapped. admit, if not nil, is called first under chunkLock, as commit
+// calls apply, and refuses the chunk by returning an error.
+func allocChunkID(admit func() os.Error) (id uint64, version uint64, err os.Error) {
+	e := new(logEntry)
+	e.Op = opAllocChunk
+	e.Version = nextVersion()
+
+	if oplog != nil {
+		oplog.lock.Lock()
+		defer oplog.lock.Unlock()
+	}
+
+	if admit != nil {
+		chunkLock.Lock()
+		err = admit()
+		chunkLock.Unlock()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if oplog != nil {
+		e.ChunkID = nextChunk
+		err = oplog.append(e)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	id = nextChunk
+	nextChunk++
+	setAllocated(id, e.Version, true)
+
+	return id, e.Version, nil
+}
+
+func (l *opLog) append(e *logEntry) os.Error {
+	e.Seq = l.seq + 1
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(e)
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, 4+buf.Len())
+	binary.BigEndian.PutUint32(record[0:4], uint32(buf.Len()))
+	copy(record[4:], buf.Bytes())
+
+	_, err = l.file.Write(record)
+	if err != nil {
+		return err
+	}
+
+	err = l.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	l.seq = e.Seq
+	l.pending++
+
+	return nil
+}
+
+// replay applies every intact record newer than the checkpoint and returns
+// how many it applied and the offset just past the last intact record.
+func (l *opLog) replay() (n int, end int64, err os.Error) {
+	r := bufio.NewReader(l.file)
+
+	for {
+		var body []byte
+		var e *logEntry
+
+		body, e, err = nextRecord(r)
+		if err != nil {
+			break
+		}
+
+		end += int64(4 + len(body))
+
+		if e.Seq <= l.seq {
+			continue
+		}
+
+		opTime = e.Time
+		aerr := e.replay()
+		opTime = 0
+		if aerr != nil {
+			log.Printf("master: replay: seq %d op %d on %s: %s\n", e.Seq, e.Op, e.Name, aerr.String())
+		}
+
+		l.seq = e.Seq
+		n++
+	}
+
+	if err == os.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	} else if err != nil {
+		log.Printf("master: replay: stopping at offset %d: %s\n", end, err.String())
+		err = nil
+	}
+
+	return n, end, err
+}
+
+// nextRecord reads one length-prefixed record, returning its encoded body
+// along with the decoded entry.
+func nextRecord(r io.Reader) (body []byte, e *logEntry, err os.Error) {
+	hdr := make([]byte, 4)
+	_, err = io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body = make([]byte, binary.BigEndian.Uint32(hdr))
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	e, err = decodeEntry(body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return body, e, nil
+}
+
+func decodeEntry(body []byte) (*logEntry, os.Error) {
+	e := new(logEntry)
+	err := gob.NewDecoder(bytes.NewBuffer(body)).Decode(e)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *logEntry) replay() os.Error {
+	chunkLock.Lock()
+	defer chunkLock.Unlock()
+
+	switch e.Op {
+	case opMakeDir:
+		return makeDir(e.Name, e.Owner, e.Group)
+	case opRemoveDir:
+		return RemoveDir(e.Name, e.Recursive)
+	case opCreateFile:
+		file, err := AddFile(e.Name, e.Owner, e.Group)
+		if err == nil && e.ChunkSize != 0 {
+			file.chunkSize = e.ChunkSize
+		}
+		return err
+	case opDeleteFile:
+		return DeleteFile(e.Name)
+	case opRemoveFile:
+		return RemoveFile(e.Name)
+	case opMapChunk:
+		var info sfs.ChunkInfo
+		info.ChunkID = e.ChunkID
+		info.Size = e.Size
+		info.Hash = e.Hash
+		info.Version = e.Version
+		return mapChunkToFile(e.Name, e.Offset, info)
+	case opAllocChunk:
+		if e.ChunkID >= nextChunk {
+			nextChunk = e.ChunkID + 1
+		}
+		sawVersion(e.Version)
+		setAllocated(e.ChunkID, e.Version, true)
+		return nil
+	case opSetLayout:
+		return setLayout(e.Name, e.ChunkSize, e.Replicas, e.Clear)
+	case opRename:
+		return Rename(e.Name, e.NewName, e.Overwrite)
+	case opChmod:
+		return chmod(e.Name, e.Mode)
+	case opChown:
+		return chown(e.Name, e.Owner, e.Group)
+	case opSetQuota:
+		return setQuota(e.Name, e.Owner, e.Size, e.Files)
+	case opDrain:
+		return drain(e.Name, e.Clear)
+	}
+
+	return os.NewError("unknown log op")
+}
+
+func (l *opLog) checkpointer() {
+	for {
+		time.Sleep(CHECKPOINT_WAIT)
+
+		l.lock.Lock()
+		if l.pending > 0 {
+			err := l.checkpoint()
+			if err != nil {
+				log.Printf("master: checkpointer: %s\n", err.String())
+			}
+		}
+		l.lock.Unlock()
+	}
+}
+
+// checkpoint writes the whole namespace out and truncates the log. The
+// caller holds l.lock.
+func (l *opLog) checkpoint() os.Error {
+	chunkLock.Lock()
+	expireAllocated(time.Nanoseconds())
+	cp := snapshot()
+	chunkLock.Unlock()
+	cp.Seq = l.seq
+
+	tmpName := path.Join(l.dir, checkpointName+".tmp")
+	f, err := os.Open(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewEncoder(f).Encode(cp)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpName, path.Join(l.dir, checkpointName))
+	if err != nil {
+		return err
+	}
+
+	//the rename has to be on disk before the log it replaces goes
+	err = syncDir(l.dir)
+	if err != nil {
+		return err
+	}
+
+	//everything in the log is in the checkpoint now
+	err = l.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	l.base = l.seq
+	l.pending = 0
+
+	log.Printf("master: checkpoint: seq %d, %d files, %d chunks\n", cp.Seq, len(cp.Files), len(cp.Chunks))
+
+	return l.file.Sync()
+}
+
+// syncDir forces the entries of directory dir, such as a file just renamed
+// into it, to disk.
+func syncDir(dir string) os.Error {
+	d, err := os.Open(dir, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+func readCheckpoint(name string) (*checkpoint, os.Error) {
+	_, err := os.Stat(name)
+	if err != nil {
+		//no checkpoint yet
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeCheckpoint(data)
+}
+
+func decodeCheckpoint(data []byte) (*checkpoint, os.Error) {
+	cp := new(checkpoint)
+	err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(cp)
+	if err != nil {
+		return nil, err
+	}
+
+	return cp, nil
+}
+
+func snapshot() *checkpoint {
+	cp := new(checkpoint)
+	cp.NextChunk = nextChunk
+
+	seen := make(map[uint64](*chunk))
+	for id, c := range chunks {
+		seen[id] = c
+	}
+
+	//parents come before their children, so restore can make them in order
+	walkDirs("/", func(dir string, d *dirNode) {
+		cp.Dirs = append(cp.Dirs, dir)
+
+		rec := dirRecord{Name: dir, Owner: d.owner, Group: d.group, Mode: d.permissions, Ctime: d.ctime, Mtime: d.mtime}
+		rec.QuotaBytes = d.maxBytes
+		rec.QuotaFiles = d.maxFiles
+		if d.layout != nil {
+			rec.ChunkSize = d.layout.chunkSize
+			rec.Replicas = d.layout.replicas
+		}
+		cp.Layouts = append(cp.Layouts, rec)
+	})
+
+	walkFiles("/", func(name string, file *inode) {
+		var rec fileRecord
+		rec.Name = name
+		rec.Size = file.size
+		rec.ChunkSize = file.chunkSize
+		rec.Replicas = file.replicas
+		rec.Owner = file.owner
+		rec.Group = file.group
+		rec.Mode = file.permissions
+		rec.Ctime = file.ctime
+		rec.Mtime = file.mtime
+		rec.Atime = file.atime
+		rec.Chunks = make([]uint64, file.chunks.Len())
+		for j := 0; j < file.chunks.Len(); j++ {
+			c := file.chunks.At(j).(*chunk)
+			rec.Chunks[j] = c.chunkID
+			seen[c.chunkID] = c
+		}
+
+		cp.Files = append(cp.Files, rec)
+	})
+
+	quotaLock.Lock()
+	for user, u := range userUsage {
+		if u.maxBytes != 0 || u.maxFiles != 0 {
+			cp.Quotas = append(cp.Quotas, quotaRecord{user, u.maxBytes, u.maxFiles})
+		}
+	}
+	quotaLock.Unlock()
+
+	cp.Chunks = make([]chunkRecord, 0, len(seen))
+	for _, c := range seen {
+		cp.Chunks = append(cp.Chunks, chunkRecord{c.chunkID, c.size, c.hash, c.version})
+	}
+
+	for str := range drainingAddrs {
+		cp.Draining = append(cp.Draining, str)
+	}
+
+	versionLock.Lock()
+	for id, version := range allocated {
+		cp.Allocated = append(cp.Allocated, chunkRecord{ChunkID: id, Version: version})
+	}
+	versionLock.Unlock()
+
+	return cp
+}
+
+// restore loads cp into the empty tables. It fails on a checkpoint that
+// doesn't hang together, such as a file made of a chunk it doesn't list.
+func restore(cp *checkpoint) os.Error {
+	chunkLock.Lock()
+	defer chunkLock.Unlock()
+
+	nextChunk = cp.NextChunk
+
+	for _, rec := range cp.Allocated {
+		sawVersion(rec.Version)
+		setAllocated(rec.ChunkID, rec.Version, true)
+	}
+
+	for _, rec := range cp.Chunks {
+		c := new(chunk)
+		c.chunkID = rec.ChunkID
+		c.size = rec.Size
+		c.hash = rec.Hash
+		c.version = rec.Version
+		c.servers = new(vector.Vector)
+		sawVersion(c.version)
+
+		chunks[c.chunkID] = c
+		if c.hash != nil {
+			hashToChunkMap[string(c.hash)] = c
+		}
+	}
+
+	for _, dir := range cp.Dirs {
+		if dir == "/" {
+			continue
+		}
+		err := makeDir(dir, "", "")
+		if err != nil {
+			log.Printf("master: restore: dir %s: %s\n", dir, err.String())
+		}
+	}
+
+	for _, rec := range cp.Layouts {
+		d, err := lookupDir(rec.Name)
+		if err != nil {
+			log.Printf("master: restore: layout for %s: %s\n", rec.Name, err.String())
+			continue
+		}
+
+		if rec.ChunkSize != 0 || rec.Replicas != 0 {
+			d.layout = new(layout)
+			d.layout.chunkSize = rec.ChunkSize
+			d.layout.replicas = rec.Replicas
+		}
+	}
+
+	for _, rec := range cp.Files {
+		file, err := AddFile(rec.Name, rec.Owner, rec.Group)
+		if err != nil {
+			log.Printf("master: restore: file %s: %s\n", rec.Name, err.String())
+			continue
+		}
+
+		file.size = rec.Size
+		if rec.ChunkSize != 0 {
+			file.chunkSize = rec.ChunkSize
+		}
+		file.replicas = rec.Replicas
+		if rec.Mode != 0 {
+			file.permissions = rec.Mode
+			file.ctime = rec.Ctime
+			file.mtime = rec.Mtime
+			file.atime = rec.Atime
+		}
+
+		r := fileReplicas(rec.Name, file)
+		for _, id := range rec.Chunks {
+			c, ok := chunks[id]
+			if !ok {
+				return os.NewError("checkpoint: file " + rec.Name + " has unknown chunk " + strconv.Uitoa64(id))
+			}
+			c.refCt++
+			if r > c.replicas {
+				c.replicas = r
+			}
+			file.chunks.Push(c)
+		}
+	}
+
+	//last, since adding the files above touched their directories' times
+	for _, rec := range cp.Layouts {
+		d, err := lookupDir(rec.Name)
+		if err != nil {
+			continue
+		}
+
+		d.maxBytes = rec.QuotaBytes
+		d.maxFiles = rec.QuotaFiles
+		if rec.Mode == 0 {
+			continue
+		}
+		d.owner = rec.Owner
+		d.group = rec.Group
+		d.permissions = rec.Mode
+		d.ctime = rec.Ctime
+		d.mtime = rec.Mtime
+	}
+
+	for _, rec := range cp.Quotas {
+		setQuota("", rec.User, rec.Bytes, rec.Files)
+	}
+
+	for _, str := range cp.Draining {
+		drain(str, false)
+	}
+
+	//file sizes were filled in after the files were added and charged
+	recountUsage()
+	return nil
+}
@@ -0,0 +1,348 @@
+package master
+
+import (
+	"os"
+	"log"
+	"../include/sfs"
+)
+
+//permission bits, as they sit in the "other" position of a mode
+const (
+	permExec  = 1
+	permWrite = 2
+	permRead  = 4
+)
+
+var errPermission = os.NewError(sfs.ERR_PERMISSION)
+
+// superuser is the name that passes every permission check, if any. The
+// identity a client sends is never checked, so there is none by default.
+var superuser string
+
+// SetSuperuser names the user who passes every permission check, or with
+// "" leaves nobody able to. Whoever can reach the master can claim the
+// name, so it is for trusted networks only. A standby fetches the log as
+// this user, so it has to name the same one as its primary. It must be
+// called before the master takes RPCs.
+func SetSuperuser(name string) {
+	superuser = name
+}
+
+func isSuperuser(cred *sfs.Cred) bool {
+	return superuser != "" && cred.User == superuser
+}
+
+// checkAdmin lets the superuser run the calls that steer the whole
+// cluster. With no superuser configured there is nobody to trust more than
+// anyone else, and they stay open to every caller.
+func checkAdmin(cred *sfs.Cred) os.Error {
+	if superuser != "" && !isSuperuser(cred) {
+		return errPermission
+	}
+	return nil
+}
+
+func inGroup(cred *sfs.Cred, group string) bool {
+	if group == "" {
+		return false
+	}
+	for _, g := range cred.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed checks want against the owner, group or other bits of mode,
+// whichever apply to cred. An anonymous caller only ever gets the other
+// bits.
+func allowed(cred *sfs.Cred, owner string, group string, mode uint64, want uint64) bool {
+	if isSuperuser(cred) {
+		return true
+	}
+
+	bits := mode
+	if cred.User != "" && cred.User == owner {
+		bits = mode >> 6
+	} else if inGroup(cred, group) {
+		bits = mode >> 3
+	}
+	return bits&want == want
+}
+
+func (d *dirNode) allows(cred *sfs.Cred, want uint64) bool {
+	return allowed(cred, d.owner, d.group, d.permissions, want)
+}
+
+func (i *inode) allows(cred *sfs.Cred, want uint64) bool {
+	return allowed(cred, i.owner, i.group, i.permissions, want)
+}
+
+// search walks parts down from the root, needing search permission on
+// every directory it passes through. The caller holds nsLock.
+func search(cred *sfs.Cred, parts []string) (*dirNode, os.Error) {
+	d := root
+	for _, name := range parts {
+		if !d.allows(cred, permExec) {
+			return nil, errPermission
+		}
+		next, ok := d.dirs[name]
+		if !ok {
+			return nil, os.NewError("no such directory")
+		}
+		d = next
+	}
+	return d, nil
+}
+
+// checkDir needs want on the directory p, and search on the way to it.
+func checkDir(cred *sfs.Cred, p string, want uint64) os.Error {
+	parts, err := splitPath(p)
+	if err != nil {
+		return err
+	}
+
+	nsLock.Lock()
+	defer nsLock.Unlock()
+
+	d, err := search(cred, parts)
+	if err != nil {
+		return err
+	}
+	if !d.allows(cred, want) {
+		return errPermission
+	}
+	return nil
+}
+
+// checkSearch needs search on every directory on the way to p, which is
+// all it takes to see p's attributes.
+func checkSearch(cred *sfs.Cred, p string) os.Error {
+	parts, err := splitPath(p)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		return nil
+	}
+
+	nsLock.Lock()
+	defer nsLock.Unlock()
+
+	_, err = search(cred, parts[:len(parts)-1])
+	return err
+}
+
+// checkParent needs want, and search, on the directory holding p. Adding
+// or removing a name takes write permission there.
+func checkParent(cred *sfs.Cred, p string, want uint64) os.Error {
+	parts, err := splitPath(p)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		return os.NewError("the root directory has no parent")
+	}
+
+	nsLock.Lock()
+	defer nsLock.Unlock()
+
+	d, err := search(cred, parts[:len(parts)-1])
+	if err != nil {
+		return err
+	}
+	if !d.allows(cred, want|permExec) {
+		return errPermission
+	}
+	return nil
+}
+
+// checkFile needs want on the file p, and search on the way to it.
+func checkFile(cred *sfs.Cred, p string, want uint64) os.Error {
+	parts, err := splitPath(p)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		return os.NewError("not a file")
+	}
+
+	nsLock.Lock()
+	defer nsLock.Unlock()
+
+	d, err := search(cred, parts[:len(parts)-1])
+	if err != nil {
+		return err
+	}
+	if !d.allows(cred, permExec) {
+		return errPermission
+	}
+
+	file, ok := d.files[parts[len(parts)-1]]
+	if !ok {
+		return os.NewError("file does not exist")
+	}
+	if !file.allows(cred, want) {
+		return errPermission
+	}
+	return nil
+}
+
+// checkTree needs write and search permission on every non-empty directory
+// in the subtree at p, as removing it all takes.
+func checkTree(cred *sfs.Cred, p string) os.Error {
+	var err os.Error
+	walkDirs(p, func(dir string, d *dirNode) {
+		if err == nil && !d.empty() && !d.allows(cred, permWrite|permExec) {
+			err = errPermission
+		}
+	})
+	return err
+}
+
+// owner reports the owner and group of the file or directory at p.
+func owner(p string) (user string, group string, err os.Error) {
+	if file, err := lookupFile(p); err == nil {
+		return file.owner, file.group, nil
+	}
+	d, err := lookupDir(p)
+	if err != nil {
+		return "", "", os.NewError("no such file or directory")
+	}
+	return d.owner, d.group, nil
+}
+
+// checkOwner needs cred to own p, or be the superuser.
+func checkOwner(cred *sfs.Cred, p string) os.Error {
+	user, _, err := owner(p)
+	if err != nil {
+		return err
+	}
+	if !isSuperuser(cred) && (cred.User == "" || cred.User != user) {
+		return errPermission
+	}
+	return nil
+}
+
+// primaryGroup is the group new files made by cred get.
+func primaryGroup(cred *sfs.Cred) string {
+	if len(cred.Groups) == 0 {
+		return ""
+	}
+	return cred.Groups[0]
+}
+
+func (m *Master) Chmod(args *sfs.ChmodArgs, ret *sfs.ChmodReturn) os.Error {
+	if err := primaryOnly(); err != nil {
+		return err
+	}
+
+	ret.Status = sfs.FAIL
+
+	if args.Mode&^0777 != 0 {
+		return os.NewError("mode has bits other than permissions")
+	}
+	if err := checkOwner(&args.Cred, args.Name); err != nil {
+		return err
+	}
+
+	e := &logEntry{Op: opChmod, Name: args.Name, Mode: args.Mode}
+	err := commit(e, func() os.Error {
+		return chmod(args.Name, args.Mode)
+	})
+	if err != nil {
+		return err
+	}
+
+	ret.Status = sfs.SUCCESS
+	return nil
+}
+
+// Chown hands a file or directory to another owner, which only the
+// superuser may do, or moves it to another group, which its owner may do
+// for any group they are in.
+func (m *Master) Chown(args *sfs.ChownArgs, ret *sfs.ChownReturn) os.Error {
+	if err := primaryOnly(); err != nil {
+		return err
+	}
+
+	ret.Status = sfs.FAIL
+
+	if !isSuperuser(&args.Cred) {
+		user, _, err := owner(args.Name)
+		if err != nil {
+			return err
+		}
+		if args.Owner != "" && args.Owner != user {
+			return errPermission
+		}
+		if err := checkOwner(&args.Cred, args.Name); err != nil {
+			return err
+		}
+		if args.Group != "" && !inGroup(&args.Cred, args.Group) {
+			return errPermission
+		}
+	}
+
+	e := &logEntry{Op: opChown, Name: args.Name, Owner: args.Owner, Group: args.Group}
+	err := commit(e, func() os.Error {
+		return chown(args.Name, args.Owner, args.Group)
+	})
+	if err != nil {
+		return err
+	}
+
+	ret.Status = sfs.SUCCESS
+	return nil
+}
+
+func chmod(name string, mode uint64) os.Error {
+	if file, err := lookupFile(name); err == nil {
+		file.permissions = mode
+		file.ctime = now()
+		file.version = nextVersion()
+		return nil
+	}
+
+	d, err := lookupDir(name)
+	if err != nil {
+		return os.NewError("no such file or directory")
+	}
+	d.permissions = mode
+	d.ctime = now()
+	d.version = nextVersion()
+	return nil
+}
+
+func chown(name string, user string, group string) os.Error {
+	log.Printf("master: chown: %s to %s:%s\n", name, user, group)
+
+	if file, err := lookupFile(name); err == nil {
+		if user != "" && user != file.owner {
+			chargeUser(file.owner, -int64(file.size), -1)
+			chargeUser(user, int64(file.size), 1)
+			file.owner = user
+		}
+		if group != "" {
+			file.group = group
+		}
+		file.ctime = now()
+		file.version = nextVersion()
+		return nil
+	}
+
+	d, err := lookupDir(name)
+	if err != nil {
+		return os.NewError("no such file or directory")
+	}
+	if user != "" {
+		d.owner = user
+	}
+	if group != "" {
+		d.group = group
+	}
+	d.ctime = now()
+	d.version = nextVersion()
+	return nil
+}
@@ -0,0 +1,280 @@
+package master
+
+import (
+	"os"
+	"log"
+	"path"
+	"sync"
+	"../include/sfs"
+)
+
+// usage is what one user's files take up, and what they may take up. A
+// zero limit means no limit.
+type usage struct {
+	bytes    uint64
+	files    uint64
+	maxBytes uint64
+	maxFiles uint64
+}
+
+var errQuota = os.NewError(sfs.ERR_QUOTA)
+
+var quotaLock sync.Mutex
+var userUsage map[string](*usage)
+
+func resetQuotas() {
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+
+	userUsage = make(map[string](*usage))
+}
+
+func userFor(owner string) *usage {
+	u, ok := userUsage[owner]
+	if !ok {
+		u = new(usage)
+		userUsage[owner] = u
+	}
+	return u
+}
+
+func add(n uint64, delta int64) uint64 {
+	if delta < 0 && uint64(-delta) > n {
+		return 0
+	}
+	return uint64(int64(n) + delta)
+}
+
+// charge adds to the usage of d and of every directory above it. The
+// caller holds nsLock.
+func (d *dirNode) charge(bytes int64, files int64) {
+	for ; d != nil; d = d.parent {
+		d.usedBytes = add(d.usedBytes, bytes)
+		d.usedFiles = add(d.usedFiles, files)
+	}
+}
+
+func chargeUser(owner string, bytes int64, files int64) {
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+
+	u := userFor(owner)
+	u.bytes = add(u.bytes, bytes)
+	u.files = add(u.files, files)
+}
+
+// chargeFile accounts for the file at name, owned by owner, changing size
+// by bytes.
+func chargeFile(name string, owner string, bytes int64) {
+	if bytes == 0 {
+		return
+	}
+
+	nsLock.Lock()
+	d, _, err := lookupParent(name)
+	if err == nil {
+		d.charge(bytes, 0)
+	}
+	nsLock.Unlock()
+
+	chargeUser(owner, bytes, 0)
+}
+
+// roomFor reports whether d and the directories above it can take bytes
+// and files moved in from src, less what a file replaced in d frees up.
+// Directories above src as well see no change, so they aren't checked.
+// The caller holds nsLock.
+func (d *dirNode) roomFor(src *dirNode, bytes uint64, files uint64, freedBytes uint64, freedFiles uint64) bool {
+	for ; d != nil; d = d.parent {
+		if d.holds(src) {
+			break
+		}
+		if d.maxBytes != 0 && d.usedBytes+bytes > d.maxBytes+freedBytes {
+			return false
+		}
+		if d.maxFiles != 0 && d.usedFiles+files > d.maxFiles+freedFiles {
+			return false
+		}
+	}
+	return true
+}
+
+// overQuota reports whether adding bytes and files at name, owned by
+// owner, would take its directory, any directory above, or its owner past
+// a limit.
+func overQuota(name string, owner string, bytes uint64, files uint64) bool {
+	nsLock.Lock()
+	d, _, err := lookupParent(name)
+	for ; err == nil && d != nil; d = d.parent {
+		if d.maxBytes != 0 && d.usedBytes+bytes > d.maxBytes {
+			break
+		}
+		if d.maxFiles != 0 && d.usedFiles+files > d.maxFiles {
+			break
+		}
+	}
+	nsLock.Unlock()
+	if err == nil && d != nil {
+		return true
+	}
+
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+
+	u, ok := userUsage[owner]
+	if !ok {
+		return false
+	}
+	return (u.maxBytes != 0 && u.bytes+bytes > u.maxBytes) ||
+		(u.maxFiles != 0 && u.files+files > u.maxFiles)
+}
+
+// growth is how many bytes mapping a chunk of size bytes at offset would
+// add to file.
+func growth(file *inode, offset int, size uint64) uint64 {
+	if offset < file.chunks.Len() {
+		old := file.chunks.At(offset).(*chunk).size
+		if size <= old {
+			return 0
+		}
+		return size - old
+	}
+	return size
+}
+
+// recountUsage works out every directory's and user's usage afresh from
+// the namespace, as after loading a checkpoint.
+func recountUsage() {
+	nsLock.Lock()
+	defer nsLock.Unlock()
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+
+	for _, u := range userUsage {
+		u.bytes = 0
+		u.files = 0
+	}
+
+	var count func(d *dirNode)
+	count = func(d *dirNode) {
+		d.usedBytes = 0
+		d.usedFiles = 0
+		for _, file := range d.files {
+			d.usedBytes += file.size
+			d.usedFiles++
+
+			u := userFor(file.owner)
+			u.bytes += file.size
+			u.files++
+		}
+		for _, sub := range d.dirs {
+			count(sub)
+			d.usedBytes += sub.usedBytes
+			d.usedFiles += sub.usedFiles
+		}
+	}
+	count(root)
+}
+
+// Quota limits the directory subtree at Dir, or everything User owns,
+// to MaxBytes logical bytes and MaxFiles files. Only the superuser may set
+// quotas. Without Set it just reports usage: of Dir, of User, or if
+// neither is given of every quota set plus the caller's own usage.
+func (m *Master) Quota(args *sfs.QuotaArgs, ret *sfs.QuotaReturn) os.Error {
+	ret.Status = sfs.FAIL
+
+	if args.Set {
+		if err := primaryOnly(); err != nil {
+			return err
+		}
+		if !isSuperuser(&args.Cred) {
+			return errPermission
+		}
+		if (args.Dir == "") == (args.User == "") {
+			return os.NewError("set a quota on either a directory or a user")
+		}
+
+		e := &logEntry{Op: opSetQuota, Name: args.Dir, Owner: args.User, Size: args.MaxBytes, Files: args.MaxFiles}
+		err := commit(e, func() os.Error {
+			return setQuota(args.Dir, args.User, args.MaxBytes, args.MaxFiles)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if args.Dir != "" {
+		d, err := lookupDir(args.Dir)
+		if err != nil {
+			return err
+		}
+		name, _ := cleanPath(args.Dir)
+		nsLock.Lock()
+		ret.Quotas = append(ret.Quotas, d.quotaInfo(name))
+		nsLock.Unlock()
+	}
+	if args.User != "" {
+		ret.Quotas = append(ret.Quotas, userQuotaInfo(args.User))
+	}
+	if args.Dir == "" && args.User == "" {
+		walkDirs("/", func(dir string, d *dirNode) {
+			if d.maxBytes != 0 || d.maxFiles != 0 {
+				ret.Quotas = append(ret.Quotas, d.quotaInfo(path.Clean(dir)))
+			}
+		})
+
+		quotaLock.Lock()
+		users := make([]string, 0)
+		for name, u := range userUsage {
+			if u.maxBytes != 0 || u.maxFiles != 0 || name == args.Cred.User {
+				users = append(users, name)
+			}
+		}
+		quotaLock.Unlock()
+
+		for _, name := range users {
+			ret.Quotas = append(ret.Quotas, userQuotaInfo(name))
+		}
+	}
+
+	ret.Status = sfs.SUCCESS
+	return nil
+}
+
+func setQuota(dir string, user string, maxBytes uint64, maxFiles uint64) os.Error {
+	log.Printf("master: setQuota: dir %q user %q: %d bytes, %d files\n", dir, user, maxBytes, maxFiles)
+
+	if dir != "" {
+		d, err := lookupDir(dir)
+		if err != nil {
+			return err
+		}
+
+		nsLock.Lock()
+		d.maxBytes = maxBytes
+		d.maxFiles = maxFiles
+		nsLock.Unlock()
+		return nil
+	}
+
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+
+	u := userFor(user)
+	u.maxBytes = maxBytes
+	u.maxFiles = maxFiles
+	return nil
+}
+
+// quotaInfo reports d's usage and limits. The caller holds nsLock.
+func (d *dirNode) quotaInfo(name string) sfs.QuotaInfo {
+	return sfs.QuotaInfo{Dir: name, UsedBytes: d.usedBytes, UsedFiles: d.usedFiles, MaxBytes: d.maxBytes, MaxFiles: d.maxFiles}
+}
+
+func userQuotaInfo(name string) sfs.QuotaInfo {
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+
+	u := userFor(name)
+	return sfs.QuotaInfo{User: name, UsedBytes: u.bytes, UsedFiles: u.files, MaxBytes: u.maxBytes, MaxFiles: u.maxFiles}
+}
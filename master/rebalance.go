@@ -0,0 +1,175 @@
+package master
+
+import (
+	"os"
+	"log"
+	"sync"
+	"time"
+	"../include/sfs"
+)
+
+const REBALANCE_WAIT = 10 * 1000000000         // pause when the cluster is balanced
+const DEFAULT_REBALANCE_BUDGET = 8 * 1024 * 1024 // bytes a second
+const DEFAULT_REBALANCE_THRESHOLD = 0.1          // fill spread tolerated between servers
+
+// rebalancer moves chunks from the fullest servers to the emptiest, one at
+// a time, by copying a chunk to the empty server and then evicting it from
+// the full one. It runs until stopped through Master.Rebalance.
+type rebalancer struct {
+	lock       sync.Mutex
+	running    bool
+	stop       chan bool
+	budget     int64   // bytes a second
+	threshold  float64 // stop once max fill - min fill is below this
+	moved      int
+	bytesMoved uint64
+}
+
+var rebal rebalancer
+
+func (m *Master) Rebalance(args *sfs.RebalanceArgs, ret *sfs.RebalanceReturn) os.Error {
+	if err := primaryOnly(); err != nil {
+		return err
+	}
+	//anyone may ask how it is going
+	if args.Start || args.Stop {
+		if err := checkAdmin(&args.Cred); err != nil {
+			return err
+		}
+	}
+
+	rebal.lock.Lock()
+	defer rebal.lock.Unlock()
+
+	if args.Start && !rebal.running {
+		rebal.budget = args.Budget
+		if rebal.budget <= 0 {
+			rebal.budget = DEFAULT_REBALANCE_BUDGET
+		}
+		rebal.threshold = args.Threshold
+		if rebal.threshold <= 0 {
+			rebal.threshold = DEFAULT_REBALANCE_THRESHOLD
+		}
+		rebal.moved = 0
+		rebal.bytesMoved = 0
+		rebal.stop = make(chan bool, 1)
+		rebal.running = true
+
+		log.Printf("master: Rebalance: starting, budget %d bytes/s, threshold %.2f\n", rebal.budget, rebal.threshold)
+		go rebalance(rebal.stop)
+	} else if args.Stop && rebal.running {
+		log.Printf("master: Rebalance: stopping after %d moves\n", rebal.moved)
+		rebal.stop <- true
+		rebal.running = false
+	}
+
+	ret.Status = sfs.SUCCESS
+	ret.Running = rebal.running
+	ret.Moved = rebal.moved
+	ret.BytesMoved = rebal.bytesMoved
+	return nil
+}
+
+func rebalance(stop chan bool) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		rebal.lock.Lock()
+		budget, threshold := rebal.budget, rebal.threshold
+		rebal.lock.Unlock()
+
+		if standby {
+			time.Sleep(REBALANCE_WAIT)
+			continue
+		}
+
+		chunkLock.Lock()
+		c, from, to := pickMove(threshold)
+		chunkLock.Unlock()
+		if c == nil {
+			time.Sleep(REBALANCE_WAIT)
+			continue
+		}
+
+		err := moveChunk(c, from, to)
+		if err != nil {
+			log.Printf("master: rebalance: moving chunk %d failed: %s\n", c.chunkID, err.String())
+			time.Sleep(REBALANCE_WAIT)
+			continue
+		}
+
+		rebal.lock.Lock()
+		rebal.moved++
+		rebal.bytesMoved += c.size
+		rebal.lock.Unlock()
+
+		//stay inside the bandwidth budget
+		time.Sleep(int64(c.size) * 1000000000 / budget)
+	}
+}
+
+// pickMove finds a chunk to move from the fullest server to the emptiest
+// one, or returns nil if the spread in fill is within threshold. The
+// caller holds chunkLock.
+func pickMove(threshold float64) (c *chunk, from *server, to *server) {
+	for i := 0; i < sHeap.vec.Len(); i++ {
+		s := sHeap.vec.At(i).(*server)
+		if from == nil || s.fill() > from.fill() {
+			from = s
+		}
+		if !s.full() && !s.draining && (to == nil || s.fill() < to.fill()) {
+			to = s
+		}
+	}
+
+	if from == nil || to == nil || from == to || from.fill()-to.fill() < threshold {
+		return nil, nil, nil
+	}
+
+	for i := 0; i < from.chunks.Len(); i++ {
+		cand := from.chunks.At(i).(*chunk)
+		if cand.heldBy(to) || to.evicting(cand.chunkID) || inFlight(cand.chunkID) {
+			continue
+		}
+
+		//don't trade a copy in a domain of its own for one in a shared domain
+		held := cand.domains()
+		if from.failureDomain() != to.failureDomain() && held[to.failureDomain()] > 0 && held[from.failureDomain()] == 1 {
+			continue
+		}
+
+		return cand, from, to
+	}
+
+	return nil, nil, nil
+}
+
+// moveChunk copies c onto to and only then evicts it from from, so the
+// chunk never has fewer copies than it started with.
+func moveChunk(c *chunk, from *server, to *server) os.Error {
+	if !claimChunk(c.chunkID) {
+		return os.NewError("chunk is busy")
+	}
+	defer releaseChunk(c.chunkID)
+
+	err := copyChunk(c, to)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("master: moveChunk: chunk %d moved from %s to %s\n", c.chunkID, from.addr.String(), to.addr.String())
+
+	chunkLock.Lock()
+	defer chunkLock.Unlock()
+
+	if c.heldBy(from) {
+		c.dropServer(from)
+		from.evictedChunks.Push(c.chunkID)
+	}
+
+	return nil
+}
@@ -0,0 +1,443 @@
+package master
+
+import (
+	"os"
+	"log"
+	"net"
+	"sync"
+	"time"
+	"container/heap"
+	"container/vector"
+	"../include/sfs"
+)
+
+const REPLICATION_WORKERS = 4                 // replications in flight at once
+const REPLICATION_SCAN = 30 * 1000000000      // full sweep for under-replicated chunks
+const REPLICATION_IDLE = 1000000000           // queue poll interval when nothing is ready
+const REPLICATION_BACKOFF = 2 * 1000000000    // first retry delay, doubled per failure
+const REPLICATION_MAX_BACKOFF = 5 * 60 * 1000000000
+
+// replTask is a chunk waiting for more replicas.
+type replTask struct {
+	chunkID   uint64
+	live      int   // replicas when queued; fewer goes first
+	attempts  int   // failed tries so far
+	notBefore int64 // backoff: don't retry before this time
+	index     int   // position in the queue's heap
+}
+
+// replQueue orders under-replicated chunks by how few live copies they
+// have, so the chunks closest to being lost are repaired first.
+type replQueue struct {
+	vec    *vector.Vector
+	queued map[uint64](*replTask)
+}
+
+func (q *replQueue) Len() int {
+	return q.vec.Len()
+}
+
+func (q *replQueue) Less(i, j int) bool {
+	return q.vec.At(i).(*replTask).live < q.vec.At(j).(*replTask).live
+}
+
+func (q *replQueue) Swap(i, j int) {
+	q.vec.Swap(i, j)
+	q.vec.At(i).(*replTask).index = i
+	q.vec.At(j).(*replTask).index = j
+}
+
+func (q *replQueue) Push(x interface{}) {
+	task := x.(*replTask)
+	task.index = q.vec.Len()
+	q.vec.Push(task)
+}
+
+func (q *replQueue) Pop() interface{} {
+	return q.vec.Pop()
+}
+
+var replLock sync.Mutex
+var replications *replQueue
+var replInFlight map[uint64]bool
+var replSlots chan bool
+
+// enqueueReplication queues c if it has fewer live replicas than its
+// target. A chunk already queued moves up if it has lost more copies. The
+// caller holds chunkLock.
+func enqueueReplication(c *chunk) {
+	live := c.keptReplicas()
+	if live >= c.replicaTarget() {
+		return
+	}
+
+	replLock.Lock()
+	defer replLock.Unlock()
+
+	if replInFlight[c.chunkID] {
+		return
+	}
+
+	if task, ok := replications.queued[c.chunkID]; ok {
+		if live < task.live {
+			task.live = live
+			heap.Init(replications)
+		}
+		return
+	}
+
+	task := new(replTask)
+	task.chunkID = c.chunkID
+	task.live = live
+	heap.Push(replications, task)
+	replications.queued[c.chunkID] = task
+}
+
+// nextReplication takes the most urgent task whose backoff has passed.
+func nextReplication(now int64) *replTask {
+	replLock.Lock()
+	defer replLock.Unlock()
+
+	if replications.Len() == 0 {
+		return nil
+	}
+
+	//the head of the heap is the most urgent; only look further if it is
+	//still backing off
+	best := replications.vec.At(0).(*replTask)
+	if best.notBefore > now {
+		best = nil
+	}
+
+	for i := 1; i < replications.Len() && (best == nil || best.index != 0); i++ {
+		task := replications.vec.At(i).(*replTask)
+		if task.notBefore > now {
+			continue
+		}
+		if best == nil || task.live < best.live {
+			best = task
+		}
+	}
+
+	if best != nil {
+		heap.Remove(replications, best.index)
+		replications.queued[best.chunkID] = nil, false
+		replInFlight[best.chunkID] = true
+	}
+
+	return best
+}
+
+// retryReplication puts a failed task back with a longer backoff.
+func retryReplication(task *replTask) {
+	replLock.Lock()
+	defer replLock.Unlock()
+
+	replInFlight[task.chunkID] = false, false
+
+	delay := int64(REPLICATION_BACKOFF)
+	for i := 0; i < task.attempts && delay < REPLICATION_MAX_BACKOFF; i++ {
+		delay *= 2
+	}
+	if delay > REPLICATION_MAX_BACKOFF {
+		delay = REPLICATION_MAX_BACKOFF
+	}
+	task.attempts++
+	task.notBefore = time.Nanoseconds() + delay
+
+	heap.Push(replications, task)
+	replications.queued[task.chunkID] = task
+}
+
+func finishReplication(task *replTask) {
+	releaseChunk(task.chunkID)
+}
+
+// claimChunk marks a chunk as having its replicas worked on outside the
+// queue, so neither the queue nor the trimmer touches it meanwhile. It
+// fails if someone else already has it.
+func claimChunk(cID uint64) bool {
+	replLock.Lock()
+	defer replLock.Unlock()
+
+	if replInFlight[cID] {
+		return false
+	}
+	if _, ok := replications.queued[cID]; ok {
+		return false
+	}
+
+	replInFlight[cID] = true
+	return true
+}
+
+func releaseChunk(cID uint64) {
+	replLock.Lock()
+	defer replLock.Unlock()
+
+	replInFlight[cID] = false, false
+}
+
+func inFlight(cID uint64) bool {
+	replLock.Lock()
+	defer replLock.Unlock()
+
+	return replInFlight[cID]
+}
+
+// StartManagers starts the background work on the chunk table: the
+// replication queue and the drain monitor. It is called once the chunk
+// table is loaded, after Recover and, on a standby, Follow.
+func StartManagers() {
+	go replicationManager()
+	go drainManager()
+}
+
+// replicationManager feeds queued chunks to at most REPLICATION_WORKERS
+// concurrent replications and sweeps for under-replicated chunks now and
+// then. It idles while this master is a standby.
+func replicationManager() {
+	lastScan := int64(0)
+
+	for {
+		now := time.Nanoseconds()
+
+		if standby {
+			time.Sleep(REPLICATION_IDLE)
+			continue
+		}
+
+		if now-lastScan > REPLICATION_SCAN {
+			chunkLock.Lock()
+			n := FindMissingChunkReplicas()
+			if n > 0 {
+				log.Printf("master: replicationManager: %d under-replicated chunks\n", n)
+			}
+			n = FindExtraChunkReplicas()
+			if n > 0 {
+				log.Printf("master: replicationManager: trimmed %d over-replicated chunks\n", n)
+			}
+			n = 0
+			for _, c := range chunks {
+				if c.crowded() {
+					n++
+				}
+			}
+			chunkLock.Unlock()
+			if n > 0 {
+				log.Printf("master: replicationManager: %d chunks have every copy in one failure domain\n", n)
+			}
+			lastScan = now
+		}
+
+		task := nextReplication(now)
+		if task == nil {
+			time.Sleep(REPLICATION_IDLE)
+			continue
+		}
+
+		replSlots <- true
+		go func(task *replTask) {
+			defer func() { <-replSlots }()
+
+			err := replicateChunk(task.chunkID)
+
+			chunkLock.Lock()
+			defer chunkLock.Unlock()
+
+			if err != nil {
+				log.Printf("master: replicationManager: chunk %d attempt %d failed: %s\n", task.chunkID, task.attempts+1, err.String())
+				if _, ok := chunks[task.chunkID]; ok {
+					retryReplication(task)
+				} else {
+					finishReplication(task)
+				}
+				return
+			}
+
+			finishReplication(task)
+			if c, ok := chunks[task.chunkID]; ok {
+				enqueueReplication(c)
+			}
+		}(task)
+	}
+}
+
+// FindMissingChunkReplicas queues every chunk short of replicas and
+// reports how many there were. The caller holds chunkLock.
+func FindMissingChunkReplicas() (ret uint64) {
+	for _, c := range chunks {
+		if c.keptReplicas() < c.replicaTarget() {
+			ret += 1
+			enqueueReplication(c)
+		}
+	}
+
+	return ret
+}
+
+// FindExtraChunkReplicas evicts surplus copies of every chunk with more
+// live replicas than its target and reports how many chunks it trimmed.
+// The caller holds chunkLock.
+func FindExtraChunkReplicas() (ret uint64) {
+	for _, c := range chunks {
+		if c.servers.Len() > c.replicaTarget() && !inFlight(c.chunkID) {
+			ret += 1
+			trimChunk(c)
+		}
+	}
+
+	return ret
+}
+
+// trimChunk drops copies of c until it is back at its replica target. The
+// copies dropped first are those on draining servers, then those in a
+// failure domain that still has another copy, fullest server first, so
+// what remains is as spread out as it was and sits on the emptiest
+// machines.
+func trimChunk(c *chunk) {
+	for c.servers.Len() > c.replicaTarget() {
+		perDomain := make(map[string]int)
+		for i := 0; i < c.servers.Len(); i++ {
+			perDomain[c.servers.At(i).(*server).failureDomain()]++
+		}
+
+		var victim *server
+		victimShared := false
+		for i := 0; i < c.servers.Len(); i++ {
+			s := c.servers.At(i).(*server)
+			shared := perDomain[s.failureDomain()] > 1
+
+			if victim == nil || (s.draining && !victim.draining) {
+				victim = s
+				victimShared = shared
+				continue
+			}
+			if victim.draining && !s.draining {
+				continue
+			}
+			if (shared && !victimShared) || (shared == victimShared && s.fill() > victim.fill()) {
+				victim = s
+				victimShared = shared
+			}
+		}
+
+		log.Printf("master: trimChunk: dropping surplus copy of chunk %d on %s\n", c.chunkID, victim.addr.String())
+
+		c.dropServer(victim)
+		victim.evictedChunks.Push(c.chunkID)
+	}
+}
+
+// replicateChunk asks the best placed server without a good copy of the
+// chunk to fetch one, if the chunk is still short of copies by the time
+// its turn comes.
+func replicateChunk(cID uint64) (err os.Error) {
+	chunkLock.Lock()
+	c, ok := chunks[cID]
+	if !ok {
+		chunkLock.Unlock()
+		return os.NewError("no such chunk")
+	}
+	if c.keptReplicas() >= c.replicaTarget() {
+		//a server came back, or the target went down, while it was queued
+		chunkLock.Unlock()
+		return nil
+	}
+	if c.servers.Len() == 0 {
+		chunkLock.Unlock()
+		return os.NewError("no good copy to replicate from")
+	}
+
+	picked := sHeap.pickServers(1, c.domains(), func(s *server) bool {
+		return c.heldBy(s) || s.evicting(cID)
+	})
+	chunkLock.Unlock()
+	if len(picked) == 0 {
+		return os.NewError("no server to replicate to")
+	}
+
+	return copyChunk(c, picked[0])
+}
+
+// copyChunk has target fetch c from the servers holding it, trying the
+// least loaded holders first, and records the new copy once it is in. The
+// caller doesn't hold chunkLock: it is let go during the copy.
+func copyChunk(c *chunk, target *server) os.Error {
+	chunkLock.Lock()
+	target.writeLoad++
+
+	sources := new(vector.Vector)
+	for i := 0; i < c.servers.Len(); i++ {
+		s := c.servers.At(i).(*server)
+		j := sources.Len()
+		for j > 0 && sources.At(j-1).(*server).placementScore() > s.placementScore() {
+			j--
+		}
+		sources.Insert(j, s)
+	}
+
+	chunklist := make([]net.TCPAddr, sources.Len())
+	for cnt1 := 0; cnt1 < sources.Len(); cnt1++ {
+		chunklist[cnt1] = sources.At(cnt1).(*server).addr
+	}
+
+	str := target.addr.String()
+	log.Printf("master: copyChunk: asking %s to replicate chunk %d\n", str, c.chunkID)
+
+	args := &sfs.ReplicateChunkArgs{c.chunkID, chunklist, c.version, c.hash}
+	reply := new(sfs.ReplicateChunkReturn)
+	chunkLock.Unlock()
+
+	err := sfs.Conns.Call(str, "Server.ReplicateChunk", args, reply)
+	if err != nil {
+		return err
+	}
+	if reply.Status != sfs.SUCCESS {
+		return os.NewError("replication to " + str + " failed")
+	}
+
+	chunkLock.Lock()
+	defer chunkLock.Unlock()
+
+	//either may have gone while the copy was made
+	if chunks[c.chunkID] != c {
+		target.evictedChunks.Push(c.chunkID)
+		return os.NewError("chunk was deleted during replication")
+	}
+	if servers[target.id] != target {
+		return os.NewError("server " + str + " went away during replication")
+	}
+
+	AssociateChunkAndServer(c, target)
+	return nil
+}
+
+func (m *Master) ReplicationStatus(args *sfs.ReplicationStatusArgs, ret *sfs.ReplicationStatusReturn) os.Error {
+	replLock.Lock()
+	defer replLock.Unlock()
+
+	ret.Queued = replications.Len()
+	ret.InFlight = len(replInFlight)
+
+	for i := 0; i < replications.Len(); i++ {
+		task := replications.vec.At(i).(*replTask)
+		if task.attempts > 0 {
+			ret.Retrying++
+		}
+		if args.List {
+			ret.Chunks = append(ret.Chunks, task.chunkID)
+		}
+	}
+
+	return nil
+}
+
+func init() {
+	replications = new(replQueue)
+	replications.vec = new(vector.Vector)
+	replications.queued = make(map[uint64](*replTask))
+	replInFlight = make(map[uint64]bool)
+	replSlots = make(chan bool, REPLICATION_WORKERS)
+	heap.Init(replications)
+}
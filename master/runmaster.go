@@ -2,27 +2,54 @@ package main
 
 import (
 	"./master"
+	"../include/sfs"
 	"fmt"
 	"flag"
 	"rpc"
 	//"http"
 	"net"
-	//"log"
+	"log"
 )
 
+var metaDir *string = flag.String("meta", "meta", "directory holding the checkpoint and operation log")
+var port *string = flag.String("port", "1338", "port to serve RPCs on")
+var primary *string = flag.String("standby", "", "run as a standby of the given primary master")
+var chunkSize *uint64 = flag.Uint64("chunksize", sfs.CHUNK_SIZE, "default chunk size in bytes for new files")
+var replicas *int = flag.Int("replicas", sfs.NREPLICAS, "default number of replicas kept of each chunk")
+var superuser *string = flag.String("superuser", "", "user who passes every permission check; identities aren't authenticated, so only on a trusted network")
+
 func main(){
 	m := new(master.Master)
-	
+
 	flag.Parse()
-	
+
+	err := master.SetDefaults(*chunkSize, *replicas)
+	if err != nil {
+		log.Fatal("master: ", err)
+	}
+	master.SetSuperuser(*superuser)
+
+	//rebuild the namespace before anyone can talk to us
+	err = master.Recover(*metaDir)
+	if err != nil {
+		log.Fatal("master: recovery failed: ", err)
+	}
+
+	if *primary != "" {
+		master.Follow(*primary)
+	}
+
+	//only now is the chunk table there to work on
+	master.StartManagers()
+
 	rpc.Register(m)
 
-	l, _ := net.Listen("tcp", ":1338")
+	l, _ := net.Listen("tcp", ":" + *port)
 	/*if e != nil {
 		log.Fatal("listen error:", e)
 	}*/
 	rpc.Accept(l)
 	fmt.Println("done")
-	
-	
+
+
 }
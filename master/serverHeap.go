@@ -10,14 +10,63 @@ import (
 	"time"
 )
 
+const WRITE_LOAD_WEIGHT = 0.05 // fill each recent placement counts as
+
 type server struct {
 	addr net.TCPAddr
 	id uint64
-	capacity uint64
+	capacity uint64 // free chunk slots
+	bytesUsed uint64
+	bytesLimit uint64
+	writeLoad float64 // recent placements, halved every heartbeat
+	domain string // failure domain the server advertised, if any
+	draining bool // being decommissioned; takes no new chunks
 	chunks *vector.Vector
 	evictedChunks *vector.Vector //uint64s
 }
 
+// fill is the fraction of the server's space in use, by chunk slots or by
+// bytes, whichever is tighter.
+func (s *server) fill() float64 {
+	used := float64(s.chunks.Len())
+	f := float64(1)
+	if used+float64(s.capacity) != 0 {
+		f = used / (used + float64(s.capacity))
+	}
+	if s.bytesLimit != 0 {
+		bf := float64(s.bytesUsed) / float64(s.bytesLimit)
+		if bf > f {
+			f = bf
+		}
+	}
+	return f
+}
+
+// full reports whether the server has no room for another chunk.
+func (s *server) full() bool {
+	return s.capacity == 0 || (s.bytesLimit != 0 && s.bytesUsed >= s.bytesLimit)
+}
+
+// placementScore ranks servers for new chunks; lower is better.
+func (s *server) placementScore() float64 {
+	return s.fill() + WRITE_LOAD_WEIGHT*s.writeLoad
+}
+
+// failureDomain names the group of servers likely to fail together: the
+// label the server advertised or, with nothing better to go on, its /24,
+// on the guess that those machines share a switch.
+func (s *server) failureDomain() string {
+	if s.domain != "" {
+		return s.domain
+	}
+
+	ip := s.addr.IP.To4()
+	if ip == nil {
+		return s.addr.IP.String()
+	}
+	return fmt.Sprintf("%d.%d.%d", ip[0], ip[1], ip[2])
+}
+
 type heapCommand struct {
 	command uint64
 	server interface{}
@@ -36,9 +85,7 @@ func (s * serverHeap) Less(i, j int) bool {
 	si := s.vec.At(i).(*server)
 	sj := s.vec.At(j).(*server)
 	
-		//return (si.capacity/uint64(si.chunks.Len())) > (sj.capacity/uint64(sj.chunks.Len()))
-		return uint64(si.chunks.Len()) < uint64(sj.chunks.Len())
-	
+	return si.placementScore() < sj.placementScore()
 }
 func (s * serverHeap) Swap(i, j int)      {
 	 s.vec.Swap(i,j)
@@ -62,10 +109,11 @@ func (s * serverHeap) Remove(serv interface{}) {
     s.serverChan <- &heapCommand{2,serv,ch}
 	<-ch
 }
+// Handler carries out heap commands. Those come only from callers holding
+// chunkLock, on whose behalf it acts, so it never takes the lock itself.
 func (s * serverHeap) Handler() {
 	var rec *heapCommand
 
-	ticker := time.Tick(30 * 1000000000)
 	for{
 		select{
 		case rec = <- s.serverChan:
@@ -108,15 +156,67 @@ func (s * serverHeap) Handler() {
 				heap.Init(s)
 				rec.retChan <- &heapCommand{}
 			}
-		case <- ticker :
-			log.Printf("master: scheduled reheap\n")
-			log.Printf("BEFORE \n %s \n", s.printPresent())
-			heap.Init(s)
-			log.Printf("AFTER  \n %s \n", s.printPresent())
 		}
 	}
 }
 
+// reheap puts the heap back in order now and then, as the servers' fill
+// and load drift.
+func (s * serverHeap) reheap() {
+	for {
+		time.Sleep(30 * 1000000000)
+
+		chunkLock.Lock()
+		log.Printf("master: scheduled reheap\n")
+		log.Printf("BEFORE \n %s \n", s.printPresent())
+		heap.Init(s)
+		log.Printf("AFTER  \n %s \n", s.printPresent())
+		chunkLock.Unlock()
+	}
+}
+
+// pickServers chooses up to n distinct servers with room to spare,
+// passing over any for which skip returns true. Each pick goes to the
+// failure domain with the fewest copies so far, counting those in domains
+// (which may be nil), and within it to the best placement score.
+func (sh *serverHeap) pickServers(n int, domains map[string]int, skip func(s *server) bool) []*server {
+	picked := make([]*server, 0, n)
+	taken := make(map[uint64]bool)
+
+	used := make(map[string]int)
+	for d, cnt := range domains {
+		used[d] = cnt
+	}
+
+	for len(picked) < n {
+		var best *server
+		for i := 0; i < sh.vec.Len(); i++ {
+			s := sh.vec.At(i).(*server)
+			if taken[s.id] || s.full() || s.draining || (skip != nil && skip(s)) {
+				continue
+			}
+			if best == nil {
+				best = s
+				continue
+			}
+
+			su, bu := used[s.failureDomain()], used[best.failureDomain()]
+			if su < bu || (su == bu && s.placementScore() < best.placementScore()) {
+				best = s
+			}
+		}
+		if best == nil {
+			break
+		}
+
+		taken[best.id] = true
+		used[best.failureDomain()]++
+		picked = append(picked, best)
+	}
+
+	return picked
+}
+
 func (sh *serverHeap) printPresent() string {
 	var out string = ""
 	cnt := sh.vec.Len()
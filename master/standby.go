@@ -0,0 +1,323 @@
+package master
+
+import (
+	"os"
+	"log"
+	"net"
+	"rpc"
+	"time"
+	"gob"
+	"bytes"
+	"io/ioutil"
+	"path"
+	"container/vector"
+	"../include/sfs"
+)
+
+const FOLLOW_WAIT = 1000000000         // 1 second between log fetches
+const LOCATION_REFRESH = 10            // fetches between chunk location refreshes
+const DEFAULT_LEASE = 5 * sfs.HEARTBEAT_WAIT
+
+var standby bool
+var lastPrimaryContact int64
+
+// primaryOnly rejects calls that would mutate state on a standby.
+func primaryOnly() os.Error {
+	if standby {
+		return os.NewError(sfs.ERR_STANDBY)
+	}
+	return nil
+}
+
+// Follow turns this master into a standby of primary. It keeps pulling the
+// primary's operation log and chunk locations until it is promoted through
+// Master.Promote. Recover must have been called first.
+//
+// A standby never promotes itself. Nothing stops a primary that is cut off
+// rather than dead from taking writes, so taking over on silence alone
+// would leave two primaries on either side of a partition. An operator
+// who knows the old primary is down, or has fenced it, promotes by hand.
+func Follow(primary string) {
+	standby = true
+	lastPrimaryContact = time.Nanoseconds()
+
+	log.Printf("master: Follow: standing by for %s\n", primary)
+
+	go follow(primary)
+}
+
+func follow(primary string) {
+	var conn *rpc.Client
+	polls := 0
+	warned := false
+
+	for standby {
+		if conn == nil {
+			c, err := rpc.Dial("tcp", sfs.MasterAddr(primary))
+			if err != nil {
+				log.Printf("master: Follow: unable to dial %s: %s\n", primary, err.String())
+			} else {
+				conn = c
+			}
+		}
+
+		if conn != nil {
+			err := pull(conn, polls%LOCATION_REFRESH == 0)
+			if err != nil {
+				log.Printf("master: Follow: fetch from %s failed: %s\n", primary, err.String())
+				conn.Close()
+				conn = nil
+			} else {
+				lastPrimaryContact = time.Nanoseconds()
+				polls++
+				warned = false
+			}
+		}
+
+		if !warned && time.Nanoseconds()-lastPrimaryContact > DEFAULT_LEASE {
+			log.Printf("master: Follow: primary %s silent for %d ns; promote this standby once it is known to be down\n", primary, DEFAULT_LEASE)
+			warned = true
+		}
+
+		time.Sleep(FOLLOW_WAIT)
+	}
+
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+func pull(conn *rpc.Client, wantLocations bool) os.Error {
+	var args sfs.FetchLogArgs
+	var ret sfs.FetchLogReturn
+
+	oplog.lock.Lock()
+	args.Seq = oplog.seq
+	oplog.lock.Unlock()
+	args.WantLocations = wantLocations
+	args.Cred.User = superuser
+
+	err := conn.Call("Master.FetchLog", &args, &ret)
+	if err != nil {
+		return err
+	}
+
+	oplog.lock.Lock()
+	defer oplog.lock.Unlock()
+
+	if ret.Checkpoint != nil {
+		cp, err := decodeCheckpoint(ret.Checkpoint)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("master: Follow: installing checkpoint at seq %d\n", cp.Seq)
+		resetState()
+		err = restore(cp)
+		if err != nil {
+			//start over from nothing on the next fetch
+			resetState()
+			oplog.seq = 0
+			return err
+		}
+		oplog.seq = cp.Seq
+
+		//write it out locally so we restart from here, not from scratch
+		err = oplog.checkpoint()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, body := range ret.Records {
+		e, err := decodeEntry(body)
+		if err != nil {
+			return err
+		}
+
+		if e.Seq <= oplog.seq {
+			continue
+		}
+
+		if e.Seq != oplog.seq+1 {
+			//we missed something; start over from the primary's checkpoint
+			log.Printf("master: Follow: gap in log, have %d got %d; resyncing\n", oplog.seq, e.Seq)
+			resetState()
+			oplog.seq = 0
+			return oplog.checkpoint()
+		}
+
+		err = oplog.append(e)
+		if err != nil {
+			return err
+		}
+
+		opTime = e.Time
+		err = e.replay()
+		opTime = 0
+		if err != nil {
+			log.Printf("master: Follow: seq %d op %d on %s: %s\n", e.Seq, e.Op, e.Name, err.String())
+		}
+	}
+
+	if ret.Locations != nil {
+		applyLocations(ret.Locations)
+	}
+
+	return nil
+}
+
+// FetchLog ships the log records after args.Seq to a standby, preceded by
+// the checkpoint if the standby is too far behind for the log alone. That
+// is the whole namespace, so only the superuser may have it.
+func (m *Master) FetchLog(args *sfs.FetchLogArgs, ret *sfs.FetchLogReturn) os.Error {
+	if err := checkAdmin(&args.Cred); err != nil {
+		return err
+	}
+	if oplog == nil {
+		return os.NewError("master has no operation log")
+	}
+
+	oplog.lock.Lock()
+	defer oplog.lock.Unlock()
+
+	after := args.Seq
+	if args.Seq < oplog.base || args.Seq > oplog.seq {
+		var data []byte
+		var err os.Error
+
+		if oplog.base == 0 {
+			//never checkpointed; the log starts from an empty namespace
+			var buf bytes.Buffer
+			err = gob.NewEncoder(&buf).Encode(&checkpoint{NextChunk: 1})
+			data = buf.Bytes()
+		} else {
+			data, err = ioutil.ReadFile(path.Join(oplog.dir, checkpointName))
+		}
+		if err != nil {
+			return err
+		}
+		ret.Checkpoint = data
+		after = oplog.base
+	}
+
+	data, err := ioutil.ReadFile(path.Join(oplog.dir, logName))
+	if err != nil {
+		return err
+	}
+
+	r := bytes.NewBuffer(data)
+	for {
+		body, e, err := nextRecord(r)
+		if err != nil {
+			break
+		}
+		if e.Seq > after {
+			ret.Records = append(ret.Records, body)
+		}
+	}
+
+	ret.Seq = oplog.seq
+
+	if args.WantLocations {
+		chunkLock.Lock()
+		defer chunkLock.Unlock()
+
+		ret.Locations = make([]sfs.ChunkLocation, 0, len(chunks))
+		for id, c := range chunks {
+			var loc sfs.ChunkLocation
+			loc.ChunkID = id
+			loc.Servers = make([]net.TCPAddr, c.servers.Len())
+			for j := 0; j < c.servers.Len(); j++ {
+				loc.Servers[j] = c.servers.At(j).(*server).addr
+			}
+			ret.Locations = append(ret.Locations, loc)
+		}
+	}
+
+	return nil
+}
+
+// Promote makes a standby the primary. Unless args.Force is set it refuses
+// while the old primary is still answering log fetches.
+func (m *Master) Promote(args *sfs.PromoteArgs, ret *sfs.PromoteReturn) os.Error {
+	ret.Status = sfs.FAIL
+
+	if err := checkAdmin(&args.Cred); err != nil {
+		return err
+	}
+
+	if !standby {
+		return os.NewError("master is already primary")
+	}
+
+	if !args.Force && time.Nanoseconds()-lastPrimaryContact < DEFAULT_LEASE {
+		return os.NewError("primary is still alive; use force to override")
+	}
+
+	promote()
+	ret.Status = sfs.SUCCESS
+
+	return nil
+}
+
+func promote() {
+	oplog.lock.Lock()
+	defer oplog.lock.Unlock()
+	chunkLock.Lock()
+	defer chunkLock.Unlock()
+
+	//the locations we cached belong to servers that never birthed with us;
+	//drop them and let the chunk servers re-register
+	for _, c := range chunks {
+		c.servers = new(vector.Vector)
+	}
+	addrToServerMap = make(map[string](*server))
+
+	standby = false
+
+	log.Printf("master: promoted to primary at seq %d\n", oplog.seq)
+}
+
+// applyLocations replaces the standby's view of where each chunk lives.
+// The servers are placeholders: they are never heaped or monitored.
+func applyLocations(locs []sfs.ChunkLocation) {
+	chunkLock.Lock()
+	defer chunkLock.Unlock()
+
+	for _, loc := range locs {
+		c, ok := chunks[loc.ChunkID]
+		if !ok {
+			continue
+		}
+
+		c.servers = new(vector.Vector)
+		for _, addr := range loc.Servers {
+			s, ok := addrToServerMap[addr.String()]
+			if !ok {
+				s = new(server)
+				s.addr = addr
+				s.chunks = new(vector.Vector)
+				s.evictedChunks = new(vector.Vector)
+				addrToServerMap[addr.String()] = s
+			}
+			c.servers.Push(s)
+		}
+	}
+}
+
+// resetState throws away the namespace and chunk table ahead of a resync.
+func resetState() {
+	chunkLock.Lock()
+	defer chunkLock.Unlock()
+
+	resetNamespace()
+	chunks = make(map[uint64](*chunk))
+	hashToChunkMap = make(map[string](*chunk))
+	nextChunk = 1
+	drainingAddrs = make(map[string]bool)
+	drainedAddrs = make(map[string]bool)
+	versionLock.Lock()
+	allocated = make(map[uint64]uint64)
+	versionLock.Unlock()
+}
@@ -225,7 +225,7 @@ func recursiveDelete(path string) {
 	}
 	if(len(ls) == 0) {
 		if(path != "/") {
-			ret = client.RemoveDir(path);
+			ret = client.RemoveDir(path, false);
 			if(ret != 0) {
 				panic("RemoveDir failed")
 			}
@@ -234,7 +234,7 @@ func recursiveDelete(path string) {
 	}
 
 	//try deleting it non-empty
-	if(client.RemoveDir(path) == 0) {
+	if(client.RemoveDir(path, false) == 0) {
 		panic("it let us delete a non-empty directory!")
 	}
 
@@ -254,7 +254,7 @@ func recursiveDelete(path string) {
 
 	//try deleting it empty
 	if(path != "/") {
-		if(client.RemoveDir(path) != 0) {
+		if(client.RemoveDir(path, false) != 0) {
 			panic("couldnt delete directory!")
 		}
 	}
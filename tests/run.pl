@@ -15,14 +15,14 @@ my $outputDir = 'output';
 
 sub doLaunch {
     sys("ssh $master ".
-	"'$testdir/../master/master ".
+	"'$testdir/../master/master -meta $testdir/$outputDir/meta -superuser root ".
 	"&> $testdir/$outputDir/master.log' ".($verbose != 1 ? " &> /dev/null":"")." &");
 
     sleep(1);
 
     for(my $i = 1; $i <= $chunkCount; $i++) {
 	sys("$ssh $servers[$i] ".
-	    "'$testdir/../chunk/serv $master ".
+	    "'$testdir/../chunk/serv -data $testdir/$outputDir/chunks$i $master ".
 	    "&> $testdir/$outputDir/chunk$i.log' ".($verbose != 1 ? " &> /dev/null":"")." &");
     }
 }
@@ -118,7 +118,7 @@ sub runTest {
 		sys("$ssh $servers[1] 'killall serv'".($verbose != 1 ? " &> /dev/null":""));
 		sleep(10);
 		sys("$ssh $servers[1] ".
-		    "'$testdir/../chunk/serv $master ".
+		    "'$testdir/../chunk/serv -data $testdir/$outputDir/chunks1 $master ".
 		    "&> $testdir/$outputDir/chunk1.log' ".($verbose != 1 ? " &> /dev/null":"")." &");
 	    }
 	    exit(0);
@@ -145,7 +145,7 @@ sub runTest {
 		sleep(8);
 		print "Restarting $i\n";
 		sys("$ssh $servers[$i] ".
-		    "'$testdir/../chunk/serv $master ".
+		    "'$testdir/../chunk/serv -data $testdir/$outputDir/chunks$i $master ".
 		    "&> $testdir/$outputDir/chunk$i.log' ".($verbose != 1 ? " &> /dev/null":"")." &");
 	    }
 	    exit(0);
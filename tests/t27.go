@@ -0,0 +1,105 @@
+package main
+
+import (
+	"../client/client"
+	"fmt"
+	"flag"
+	"os"
+	"sort"
+)
+
+func createPath(path string) {
+	fd := client.Open(path, client.O_WRONLY|client.O_CREATE)
+	if(fd < 0) {
+		panic("open failed")
+	}
+	ret := client.Close(fd)
+	if(ret != client.WIN) {
+		panic("close failed")
+	}
+}
+
+func expectDir(path string, expected []string) {
+	ls, err := client.ReadDir(path)
+	if(err != 0) {
+		panic("readdir of " + path + " failed")
+	}
+	sort.SortStrings(expected)
+	sort.SortStrings(ls)
+	if(! ArrEquals(ls, expected)) {
+		fmt.Printf("Actual:\t%+v\nExpected:\t%+v\n", ls, expected)
+		panic("readdir of " + path + " differs")
+	}
+}
+
+func main(){
+	master := flag.String("m", "", "specify a master!")
+	flag.Parse();
+
+	client.Initialize(*master)
+
+	//a deep chain, each level made under the last
+	path := ""
+	for i := 0; i < 30; i++ {
+		path = fmt.Sprintf("%s/d%d", path, i)
+		if(client.MakeDir(path) != 0) {
+			panic("makedir " + path + " should work")
+		}
+	}
+	createPath(path + "/leaf")
+	expectDir(path, []string{"leaf"})
+
+	//the same directory however the path is spelled
+	if(client.MakeDir("/a") != 0) {
+		panic("makedir should work")
+	}
+	if(client.MakeDir("a/b") != 0) {
+		panic("makedir without a leading slash should work")
+	}
+	createPath("/a//b/./f")
+	expectDir("/a/b", []string{"f"})
+	expectDir("/a/b/", []string{"f"})
+	expectDir("//a/../a/b/.", []string{"f"})
+	expectDir("/a", []string{"b/"})
+
+	if(client.MakeDir("/a/../a/b") == 0) {
+		panic("makedir of an existing directory shouldn't work")
+	}
+
+	//a name is either a file or a directory, never both
+	if(client.MakeDir("/a/b/f") == 0) {
+		panic("makedir over a file shouldn't work")
+	}
+	if(client.Open("/a/b", client.O_WRONLY|client.O_CREATE) >= 0) {
+		panic("creating a file over a directory shouldn't work")
+	}
+	if(client.MakeDir("/a/b/f/g") == 0) {
+		panic("makedir under a file shouldn't work")
+	}
+	expectDir("/a", []string{"b/"})
+	expectDir("/a/b", []string{"f"})
+
+	if(client.RemoveDir("/a/b/f", false) == 0) {
+		panic("removedir of a file shouldn't work")
+	}
+	if(client.RemoveDir("/", true) == 0) {
+		panic("removedir of the root shouldn't work")
+	}
+
+	expectDir("/", []string{"a/", "d0/"})
+
+	fmt.Printf("\n{{{{{pass}}}}}\n")
+	os.Exit(0)
+}
+
+func ArrEquals(a []string, b []string) bool {
+	if(len(a) != len(b)) {
+		return false
+	}
+	for i:=0; i < len(a); i++ {
+		if(a[i] != b[i]) {
+			return false
+		}
+	}
+	return true
+}
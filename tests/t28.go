@@ -0,0 +1,161 @@
+package main
+
+import (
+	"../client/client"
+	"fmt"
+	"flag"
+	"os"
+	"sort"
+)
+
+func writePath(path string, data string) {
+	fd := client.Open(path, client.O_WRONLY|client.O_CREATE)
+	if(fd < 0) {
+		panic("open of " + path + " failed")
+	}
+	if(client.Write(fd, []byte(data)) != 0) {
+		panic("write of " + path + " failed")
+	}
+	if(client.Close(fd) != client.WIN) {
+		panic("close of " + path + " failed")
+	}
+}
+
+func expectContents(path string, data string) {
+	fd := client.Open(path, client.O_RDONLY)
+	if(fd < 0) {
+		panic("open of " + path + " failed")
+	}
+	buf, ret := client.Read(fd, len(data))
+	if(ret != 0) {
+		panic("read of " + path + " failed")
+	}
+	if(string(buf) != data) {
+		fmt.Printf("Actual:\t%s\nExpected:\t%s\n", string(buf), data)
+		panic("contents of " + path + " differ")
+	}
+	if(client.Close(fd) != client.WIN) {
+		panic("close of " + path + " failed")
+	}
+}
+
+func expectDir(path string, expected []string) {
+	ls, err := client.ReadDir(path)
+	if(err != 0) {
+		panic("readdir of " + path + " failed")
+	}
+	sort.SortStrings(expected)
+	sort.SortStrings(ls)
+	if(! ArrEquals(ls, expected)) {
+		fmt.Printf("Actual:\t%+v\nExpected:\t%+v\n", ls, expected)
+		panic("readdir of " + path + " differs")
+	}
+}
+
+func main(){
+	master := flag.String("m", "", "specify a master!")
+	flag.Parse();
+
+	client.Initialize(*master)
+
+	if(client.MakeDir("/tmp") != 0 || client.MakeDir("/pub") != 0) {
+		panic("makedir should work")
+	}
+
+	//publish through a temp name
+	writePath("/tmp/report", "first")
+	if(client.Rename("/tmp/report", "/pub/report", false) != 0) {
+		panic("rename of a file should work")
+	}
+	expectDir("/tmp", []string{})
+	expectDir("/pub", []string{"report"})
+	expectContents("/pub/report", "first")
+
+	//replacing needs overwrite
+	writePath("/tmp/report", "second")
+	if(client.Rename("/tmp/report", "/pub/report", false) == 0) {
+		panic("rename over a file without overwrite shouldn't work")
+	}
+	expectContents("/pub/report", "first")
+	if(client.Rename("/tmp/report", "/pub/report", true) != 0) {
+		panic("rename over a file with overwrite should work")
+	}
+	expectDir("/tmp", []string{})
+	expectContents("/pub/report", "second")
+
+	//a directory moves with everything in it
+	if(client.MakeDir("/tmp/a") != 0 || client.MakeDir("/tmp/a/b") != 0 || client.MakeDir("/tmp/a/b/c") != 0) {
+		panic("makedir should work")
+	}
+	writePath("/tmp/a/b/c/f", "deep")
+	if(client.Rename("/tmp/a", "/pub/a", false) != 0) {
+		panic("rename of a directory should work")
+	}
+	expectDir("/tmp", []string{})
+	expectContents("/pub/a/b/c/f", "deep")
+
+	//not into its own subtree, however deep
+	if(client.Rename("/pub/a", "/pub/a/b", true) == 0) {
+		panic("rename of a directory onto its child shouldn't work")
+	}
+	if(client.Rename("/pub/a", "/pub/a/b/c/x", false) == 0) {
+		panic("rename of a directory into its own subtree shouldn't work")
+	}
+	if(client.Rename("/pub/a/b", "/pub/a/b/c/b", false) == 0) {
+		panic("rename of a subdirectory into its own subtree shouldn't work")
+	}
+	expectDir("/pub/a", []string{"b/"})
+	expectDir("/pub/a/b/c", []string{"f"})
+
+	//files and directories don't replace each other
+	if(client.Rename("/pub/report", "/pub/a", true) == 0) {
+		panic("rename of a file over a directory shouldn't work")
+	}
+	if(client.Rename("/pub/a", "/pub/report", true) == 0) {
+		panic("rename of a directory over a file shouldn't work")
+	}
+
+	//only an empty directory is replaced
+	if(client.MakeDir("/tmp/empty") != 0) {
+		panic("makedir should work")
+	}
+	if(client.Rename("/tmp/empty", "/pub/a", true) == 0) {
+		panic("rename over a non-empty directory shouldn't work")
+	}
+	if(client.MakeDir("/pub/e") != 0) {
+		panic("makedir should work")
+	}
+	if(client.Rename("/tmp/empty", "/pub/e", false) == 0) {
+		panic("rename over a directory without overwrite shouldn't work")
+	}
+	if(client.Rename("/tmp/empty", "/pub/e", true) != 0) {
+		panic("rename over an empty directory with overwrite should work")
+	}
+
+	//nothing to move, or nowhere to put it
+	if(client.Rename("/tmp/missing", "/pub/missing", false) == 0) {
+		panic("rename of a missing file shouldn't work")
+	}
+	writePath("/tmp/orphan", "orphan")
+	if(client.Rename("/tmp/orphan", "/nowhere/orphan", false) == 0) {
+		panic("rename into a missing directory shouldn't work")
+	}
+	expectContents("/tmp/orphan", "orphan")
+
+	expectDir("/pub", []string{"a/", "e/", "report"})
+
+	fmt.Printf("\n{{{{{pass}}}}}\n")
+	os.Exit(0)
+}
+
+func ArrEquals(a []string, b []string) bool {
+	if(len(a) != len(b)) {
+		return false
+	}
+	for i:=0; i < len(a); i++ {
+		if(a[i] != b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"../client/client"
+	"fmt"
+	"flag"
+	"os"
+	"sort"
+)
+
+func writePath(path string, data string) {
+	fd := client.Open(path, client.O_WRONLY|client.O_CREATE)
+	if(fd < 0) {
+		panic("open of " + path + " failed")
+	}
+	if(client.Write(fd, []byte(data)) != 0) {
+		panic("write of " + path + " failed")
+	}
+	if(client.Close(fd) != client.WIN) {
+		panic("close of " + path + " failed")
+	}
+}
+
+func expectDir(path string, expected []string) {
+	ls, err := client.ReadDir(path)
+	if(err != 0) {
+		panic("readdir of " + path + " failed")
+	}
+	sort.SortStrings(expected)
+	sort.SortStrings(ls)
+	if(! ArrEquals(ls, expected)) {
+		fmt.Printf("Actual:\t%+v\nExpected:\t%+v\n", ls, expected)
+		panic("readdir of " + path + " differs")
+	}
+}
+
+// makeTree builds depth levels of width directories each under dir, with
+// a file with some data in every one of them.
+func makeTree(dir string, depth int, width int) {
+	writePath(dir + "/file", "data in " + dir)
+	if(depth == 0) {
+		return
+	}
+	for i := 0; i < width; i++ {
+		sub := fmt.Sprintf("%s/d%d", dir, i)
+		if(client.MakeDir(sub) != 0) {
+			panic("makedir " + sub + " should work")
+		}
+		makeTree(sub, depth-1, width)
+	}
+}
+
+func main(){
+	master := flag.String("m", "", "specify a master!")
+	flag.Parse();
+
+	client.Initialize(*master)
+
+	if(client.MakeDir("/keep") != 0 || client.MakeDir("/top") != 0) {
+		panic("makedir should work")
+	}
+	writePath("/keep/file", "kept")
+	makeTree("/top", 3, 3)
+
+	//without recursive only an empty directory goes
+	if(client.RemoveDir("/top", false) == 0) {
+		panic("removedir of a non-empty directory shouldn't work")
+	}
+	if(client.RemoveDir("/top/d1/d1/d1", false) == 0) {
+		panic("removedir of a directory holding a file shouldn't work")
+	}
+	expectDir("/top/d1/d1/d1", []string{"file"})
+
+	//a subtree first, then the rest
+	if(client.RemoveDir("/top/d2", true) != 0) {
+		panic("recursive removedir of a subtree should work")
+	}
+	expectDir("/top", []string{"d0/", "d1/", "file"})
+	if(client.Open("/top/d2/d0/file", client.O_RDONLY) >= 0) {
+		panic("open of a removed file shouldn't work")
+	}
+
+	if(client.RemoveDir("/top", true) != 0) {
+		panic("recursive removedir should work")
+	}
+	expectDir("/", []string{"keep/"})
+	expectDir("/keep", []string{"file"})
+	if(client.Open("/top/d0/d0/d0/file", client.O_RDONLY) >= 0) {
+		panic("open of a removed file shouldn't work")
+	}
+	if(client.Open("/top/file", client.O_RDONLY) >= 0) {
+		panic("open of a removed file shouldn't work")
+	}
+	_, err := client.ReadDir("/top/d0")
+	if(err == 0) {
+		panic("readdir of a removed directory shouldn't work")
+	}
+
+	//nothing is left behind under the old name
+	if(client.MakeDir("/top") != 0) {
+		panic("makedir over a removed directory should work")
+	}
+	expectDir("/top", []string{})
+
+	//recursive still needs a directory
+	if(client.RemoveDir("/missing", true) == 0) {
+		panic("recursive removedir of a missing directory shouldn't work")
+	}
+	if(client.RemoveDir("/keep/file", true) == 0) {
+		panic("recursive removedir of a file shouldn't work")
+	}
+	expectDir("/keep", []string{"file"})
+
+	fmt.Printf("\n{{{{{pass}}}}}\n")
+	os.Exit(0)
+}
+
+func ArrEquals(a []string, b []string) bool {
+	if(len(a) != len(b)) {
+		return false
+	}
+	for i:=0; i < len(a); i++ {
+		if(a[i] != b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"../client/client"
+	"fmt"
+	"flag"
+	"os"
+	"time"
+	"../include/sfs"
+)
+
+const PAUSE = 10 * 1000000 // long enough for the master's clock to move
+
+func main(){
+	master := flag.String("m", "", "specify a master!")
+	flag.Parse();
+
+	client.Initialize(*master)
+	client.SetIdentity("alice", "staff")
+
+	if(client.MakeDir("/dir") != 0) {
+		panic("makedir should work")
+	}
+	dirBefore, ret := client.Stat("/dir")
+	if(ret != 0) {
+		panic("stat of a directory should work")
+	}
+	if(!dirBefore.IsDir || dirBefore.Owner != "alice" || dirBefore.Group != "staff" || dirBefore.Mode != sfs.DEFAULT_DIR_MODE) {
+		fmt.Printf("Attr:\t%+v\n", dirBefore)
+		panic("stat of a new directory is wrong")
+	}
+	time.Sleep(PAUSE)
+
+	//a bit over one chunk, so two of them
+	fd := client.Open("/dir/file", client.O_WRONLY|client.O_CREATE)
+	if(fd < 0) {
+		panic("could not create new file")
+	}
+	size := sfs.CHUNK_SIZE + 10
+	if(client.Write(fd, make([]byte, size)) != 0) {
+		panic("write failed")
+	}
+	if(client.Close(fd) != client.WIN) {
+		panic("close failed")
+	}
+
+	attr, ret := client.Stat("/dir//file")
+	if(ret != 0) {
+		panic("stat of a file should work")
+	}
+	if(attr.IsDir || attr.Size != uint64(size) || attr.Chunks != 2) {
+		fmt.Printf("Attr:\t%+v\n", attr)
+		panic("stat has the wrong size")
+	}
+	if(attr.Owner != "alice" || attr.Group != "staff" || attr.Mode != sfs.DEFAULT_FILE_MODE) {
+		fmt.Printf("Attr:\t%+v\n", attr)
+		panic("stat has the wrong owner or mode")
+	}
+	if(attr.Replicas <= 0 || attr.ChunkSize == 0) {
+		fmt.Printf("Attr:\t%+v\n", attr)
+		panic("stat has no layout")
+	}
+	if(attr.Mtime < attr.Ctime || attr.Atime == 0) {
+		fmt.Printf("Attr:\t%+v\n", attr)
+		panic("stat has the wrong times")
+	}
+
+	//making the file changed the directory
+	dirAfter, ret := client.Stat("/dir")
+	if(ret != 0) {
+		panic("stat of a directory should work")
+	}
+	if(dirAfter.Mtime <= dirBefore.Mtime) {
+		fmt.Printf("Before:\t%+v\nAfter:\t%+v\n", dirBefore, dirAfter)
+		panic("directory mtime didn't move")
+	}
+	time.Sleep(PAUSE)
+
+	//chmod changes the mode and ctime, not the contents
+	if(client.Chmod("/dir/file", 0600) != 0) {
+		panic("chmod by the owner should work")
+	}
+	chmodded, ret := client.Stat("/dir/file")
+	if(ret != 0) {
+		panic("stat of a file should work")
+	}
+	if(chmodded.Mode != 0600 || chmodded.Ctime <= attr.Ctime || chmodded.Mtime != attr.Mtime || chmodded.Size != attr.Size) {
+		fmt.Printf("Before:\t%+v\nAfter:\t%+v\n", attr, chmodded)
+		panic("stat after chmod is wrong")
+	}
+
+	//readdir gives the same attributes per entry
+	if(client.MakeDir("/dir/sub") != 0) {
+		panic("makedir should work")
+	}
+	entries, ret := client.ReadDirAttrs("/dir")
+	if(ret != 0 || len(entries) != 2) {
+		fmt.Printf("Entries:\t%+v\n", entries)
+		panic("readdir with attributes failed")
+	}
+	for _, e := range entries {
+		if(e.Name == "sub/") {
+			if(!e.IsDir) {
+				panic("readdir says a directory is a file")
+			}
+		} else if(e.Name == "file") {
+			if(e.IsDir || e.Size != attr.Size || e.Mode != 0600 || e.Owner != "alice") {
+				fmt.Printf("Entry:\t%+v\nStat:\t%+v\n", e, chmodded)
+				panic("readdir attributes differ from stat")
+			}
+		} else {
+			panic("readdir returned " + e.Name)
+		}
+	}
+
+	_, ret = client.Stat("/dir/missing")
+	if(ret == 0) {
+		panic("stat of a missing file shouldn't work")
+	}
+
+	fmt.Printf("\n{{{{{pass}}}}}\n")
+	os.Exit(0)
+}
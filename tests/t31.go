@@ -0,0 +1,155 @@
+package main
+
+import (
+	"../client/client"
+	"fmt"
+	"flag"
+	"os"
+)
+
+func writePath(path string, data string) {
+	fd := client.Open(path, client.O_WRONLY|client.O_CREATE)
+	if(fd < 0) {
+		panic("open of " + path + " failed")
+	}
+	if(client.Write(fd, []byte(data)) != 0) {
+		panic("write of " + path + " failed")
+	}
+	if(client.Close(fd) != client.WIN) {
+		panic("close of " + path + " failed")
+	}
+}
+
+func canRead(path string) bool {
+	fd := client.Open(path, client.O_RDONLY)
+	if(fd < 0) {
+		return false
+	}
+	if(client.Close(fd) != client.WIN) {
+		panic("close of " + path + " failed")
+	}
+	return true
+}
+
+func main(){
+	master := flag.String("m", "", "specify a master!")
+	flag.Parse();
+
+	client.Initialize(*master)
+
+	//alice makes a tree that belongs to alice
+	client.SetIdentity("alice", "staff", "dev")
+	if(client.MakeDir("/alice") != 0 || client.MakeDir("/alice/sub") != 0) {
+		panic("makedir should work")
+	}
+	writePath("/alice/f", "alice's")
+	writePath("/alice/sub/g", "alice's too")
+
+	//to bob, who is other, it may be looked at but not touched
+	client.SetIdentity("bob", "users")
+	if(!canRead("/alice/f")) {
+		panic("read of a 0644 file by other should work")
+	}
+	if(client.Open("/alice/f", client.O_WRONLY) >= 0) {
+		panic("write open of a 0644 file by other shouldn't work")
+	}
+	if(client.Open("/alice/new", client.O_WRONLY|client.O_CREATE) >= 0) {
+		panic("create in a 0755 directory by other shouldn't work")
+	}
+	if(client.MakeDir("/alice/bobs") == 0) {
+		panic("makedir in a 0755 directory by other shouldn't work")
+	}
+	if(client.Delete("/alice/f") == 0) {
+		panic("delete in a 0755 directory by other shouldn't work")
+	}
+	if(client.RemoveDir("/alice", true) == 0) {
+		panic("recursive removedir of someone else's tree shouldn't work")
+	}
+	if(client.RemoveDir("/alice/sub", true) == 0) {
+		panic("recursive removedir of someone else's subtree shouldn't work")
+	}
+	if(client.Rename("/alice/f", "/stolen", false) == 0) {
+		panic("rename out of a 0755 directory by other shouldn't work")
+	}
+	if(client.MakeDir("/bob") != 0) {
+		panic("makedir should work")
+	}
+	writePath("/bob/f", "bob's")
+	if(client.Rename("/bob/f", "/alice/f", true) == 0) {
+		panic("rename into a 0755 directory by other shouldn't work")
+	}
+	if(client.Chmod("/alice/f", 0666) == 0) {
+		panic("chmod by other shouldn't work")
+	}
+	if(client.Chown("/alice/f", "bob", "") == 0) {
+		panic("chown by other shouldn't work")
+	}
+	if(client.Chown("/alice/f", "", "users") == 0) {
+		panic("chgrp by other shouldn't work")
+	}
+
+	//nor may the owner give files away, or to a group they aren't in
+	client.SetIdentity("alice", "staff", "dev")
+	if(client.Chown("/alice/f", "bob", "") == 0) {
+		panic("chown by the owner shouldn't work")
+	}
+	if(client.Chown("/alice/f", "", "users") == 0) {
+		panic("chgrp to a group the owner isn't in shouldn't work")
+	}
+	if(client.Chown("/alice/f", "", "dev") != 0) {
+		panic("chgrp to a group the owner is in should work")
+	}
+	if(client.Chmod("/alice/f", 0640) != 0) {
+		panic("chmod by the owner should work")
+	}
+	if(client.Chmod("/alice/f", 01777) == 0) {
+		panic("chmod with more than permission bits shouldn't work")
+	}
+
+	//group dev can read it, everyone else can't
+	client.SetIdentity("carol", "dev")
+	if(!canRead("/alice/f")) {
+		panic("read of a 0640 file by its group should work")
+	}
+	if(client.Open("/alice/f", client.O_WRONLY) >= 0) {
+		panic("write open of a 0640 file by its group shouldn't work")
+	}
+	client.SetIdentity("bob", "users")
+	if(canRead("/alice/f")) {
+		panic("read of a 0640 file by other shouldn't work")
+	}
+	_, ret := client.Stat("/alice/f")
+	if(ret != 0) {
+		panic("stat through a searchable directory should work")
+	}
+
+	//a closed directory hides what is in it
+	client.SetIdentity("alice", "staff", "dev")
+	if(client.Chmod("/alice", 0700) != 0) {
+		panic("chmod by the owner should work")
+	}
+	client.SetIdentity("bob", "users")
+	_, ret = client.ReadDir("/alice")
+	if(ret == 0) {
+		panic("readdir of a 0700 directory by other shouldn't work")
+	}
+	_, ret = client.Stat("/alice/f")
+	if(ret == 0) {
+		panic("stat through a 0700 directory by other shouldn't work")
+	}
+	if(canRead("/alice/sub/g")) {
+		panic("read through a 0700 directory by other shouldn't work")
+	}
+
+	//and the owner still has all of it
+	client.SetIdentity("alice", "staff", "dev")
+	if(!canRead("/alice/sub/g")) {
+		panic("read by the owner should work")
+	}
+	if(client.RemoveDir("/alice", true) != 0) {
+		panic("recursive removedir by the owner should work")
+	}
+
+	fmt.Printf("\n{{{{{pass}}}}}\n")
+	os.Exit(0)
+}
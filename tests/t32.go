@@ -0,0 +1,166 @@
+package main
+
+import (
+	"../client/client"
+	"fmt"
+	"flag"
+	"os"
+	"../include/sfs"
+)
+
+// Setting quotas takes the superuser, so this needs the master started
+// with -superuser root, as run.pl does.
+const SUPERUSER = "root"
+
+func createPath(path string) int {
+	fd := client.Open(path, client.O_WRONLY|client.O_CREATE)
+	if(fd < 0) {
+		return fd
+	}
+	if(client.Close(fd) != client.WIN) {
+		panic("close of " + path + " failed")
+	}
+	return 0
+}
+
+func writePath(path string, flag int, size int) int {
+	fd := client.Open(path, flag)
+	if(fd < 0) {
+		panic("open of " + path + " failed")
+	}
+	ret := client.Write(fd, make([]byte, size))
+	if(client.Close(fd) != client.WIN) {
+		panic("close of " + path + " failed")
+	}
+	return ret
+}
+
+func usage(dir string, user string) sfs.QuotaInfo {
+	quotas, ret := client.Quota(dir, user, false, 0, 0)
+	if(ret != 0 || len(quotas) != 1) {
+		panic("quota report failed")
+	}
+	return quotas[0]
+}
+
+func setQuota(dir string, user string, maxBytes uint64, maxFiles uint64) {
+	client.SetIdentity(SUPERUSER)
+	_, ret := client.Quota(dir, user, true, maxBytes, maxFiles)
+	if(ret != 0) {
+		panic("quota set by the superuser should work")
+	}
+}
+
+func main(){
+	master := flag.String("m", "", "specify a master!")
+	flag.Parse();
+
+	client.Initialize(*master)
+
+	chunk := uint64(sfs.CHUNK_SIZE)
+
+	client.SetIdentity(SUPERUSER)
+	if(client.MakeDir("/q") != 0 || client.Chmod("/q", 0777) != 0) {
+		panic("makedir should work")
+	}
+	setQuota("/q", "", 2*chunk, 3)
+
+	//only the superuser sets quotas
+	client.SetIdentity("alice", "staff")
+	_, ret := client.Quota("/q", "", true, 0, 0)
+	if(ret != sfs.FAIL) {
+		panic("quota set by a user should fail, and not for want of quota")
+	}
+
+	//files
+	for _, name := range []string{"/q/a", "/q/b", "/q/c"} {
+		if(createPath(name) != 0) {
+			panic("create under quota should work")
+		}
+	}
+	if(createPath("/q/d") != sfs.QUOTA_EXCEEDED) {
+		panic("create past the file quota should fail with quota exceeded")
+	}
+	if(usage("/q", "").UsedFiles != 3) {
+		panic("quota shows the wrong number of files")
+	}
+	if(client.Delete("/q/c") != 0) {
+		panic("delete should work")
+	}
+	if(createPath("/q/d") != 0) {
+		panic("create once a file has gone should work")
+	}
+	if(client.Delete("/q/d") != 0) {
+		panic("delete should work")
+	}
+
+	//bytes
+	if(writePath("/q/a", client.O_WRONLY, int(chunk)) != 0) {
+		panic("write under quota should work")
+	}
+	if(writePath("/q/b", client.O_WRONLY, int(2*chunk)) != sfs.QUOTA_EXCEEDED) {
+		panic("write past the byte quota should fail with quota exceeded")
+	}
+	u := usage("/q", "")
+	if(u.UsedBytes > u.MaxBytes || u.UsedFiles != 2) {
+		fmt.Printf("Quota:\t%+v\n", u)
+		panic("quota went past its limit")
+	}
+
+	//renames in count like anything else
+	if(client.MakeDir("/out") != 0 || client.MakeDir("/out/d") != 0) {
+		panic("makedir should work")
+	}
+	if(writePath("/out/f", client.O_WRONLY|client.O_CREATE, int(chunk)) != 0) {
+		panic("write outside the quota should work")
+	}
+	if(writePath("/out/d/g", client.O_WRONLY|client.O_CREATE, int(chunk)) != 0) {
+		panic("write outside the quota should work")
+	}
+	if(client.Rename("/out/f", "/q/f", false) != sfs.QUOTA_EXCEEDED) {
+		panic("rename of a file past the quota should fail with quota exceeded")
+	}
+	if(client.Rename("/out/d", "/q/d", false) != sfs.QUOTA_EXCEEDED) {
+		panic("rename of a directory past the quota should fail with quota exceeded")
+	}
+	if(client.MakeDir("/q/sub") != 0) {
+		panic("makedir under quota should work")
+	}
+	if(client.Rename("/q/b", "/q/sub/b", false) != 0) {
+		panic("rename within the quota should work")
+	}
+	if(client.Rename("/out/f", "/q/a", true) != 0) {
+		panic("rename over a file of the same size should work")
+	}
+	u = usage("/q", "")
+	if(u.UsedBytes > u.MaxBytes || u.UsedFiles != 2) {
+		fmt.Printf("Quota:\t%+v\n", u)
+		panic("quota went past its limit")
+	}
+
+	//users
+	setQuota("", "bob", 0, 1)
+	client.SetIdentity("bob", "users")
+	if(createPath("/bob1") != 0) {
+		panic("create under the user quota should work")
+	}
+	if(createPath("/bob2") != sfs.QUOTA_EXCEEDED) {
+		panic("create past the user quota should fail with quota exceeded")
+	}
+	if(usage("", "bob").UsedFiles != 1) {
+		panic("quota shows the wrong number of files for the user")
+	}
+
+	//lifting the limit lets it all in
+	setQuota("/q", "", 0, 0)
+	client.SetIdentity("alice", "staff")
+	if(client.Rename("/out/d", "/q/d", false) != 0) {
+		panic("rename with no quota should work")
+	}
+	if(createPath("/q/e") != 0) {
+		panic("create with no quota should work")
+	}
+
+	fmt.Printf("\n{{{{{pass}}}}}\n")
+	os.Exit(0)
+}
@@ -11,6 +11,7 @@ import (
 	"strings"
 	"flag"
 	"io/ioutil"
+	"strconv"
 )
 
 const BUFSIZE = 256
@@ -19,6 +20,8 @@ func main() {
 	
 	fmt.Printf("Hello World\n")
 	master := flag.String("m", "mumble-02.cs.wisc.edu", "specify the master")
+	user := flag.String("u", "", "act as this user, defaults to $USER (-u)")
+	groups := flag.String("g", "", "comma separated groups, primary first (-g)")
 	flag.Parse();
 	
 	if *master == "" {
@@ -30,6 +33,12 @@ func main() {
 		
 	
 	client.Initialize(*master)
+	if *user != "" {
+		if *groups == "" {
+			*groups = *user
+		}
+		client.SetIdentity(*user, strings.Split(*groups, ",", -1)...)
+	}
 
 	for {
 		buffer := make([]byte,BUFSIZE)
@@ -69,7 +78,7 @@ func main() {
 			if err == false {
 				fmt.Printf("Fatal error in ls.\n")
 			}
-		}else if strings.HasPrefix(line,"rmdirg") {
+		}else if strings.HasPrefix(line,"rmdir") {
 			err := rmdir(line)
 			if err == false {
 				fmt.Printf("Fatal error in rmdir.\n")
@@ -82,6 +91,30 @@ func main() {
 			}
 		
 	
+		}else if strings.HasPrefix(line,"mv") {
+			err := mv(line)
+			if err == false {
+				fmt.Printf("Fatal error in mv.\n")
+			}
+
+		}else if strings.HasPrefix(line,"chmod") {
+			err := chmod(line)
+			if err == false {
+				fmt.Printf("Fatal error in chmod.\n")
+			}
+
+		}else if strings.HasPrefix(line,"chown") {
+			err := chown(line)
+			if err == false {
+				fmt.Printf("Fatal error in chown.\n")
+			}
+
+		}else if strings.HasPrefix(line,"quota") {
+			err := quota(line)
+			if err == false {
+				fmt.Printf("Fatal error in quota.\n")
+			}
+
 		}else if strings.HasPrefix(line,"pwd") {
 			fmt.Printf("pwd not currently supported")
 		
@@ -116,16 +149,26 @@ func help() {
 
 	fmt.Printf("get <src> <dst>\n")
 	fmt.Printf("put <src> <dst>\n")
-	fmt.Printf("ls <dir>\n")
+	fmt.Printf("ls [-l] <dir>\n")
 	fmt.Printf("mkdir <dir>")
 	fmt.Printf("rm <file>")
 	fmt.Printf("rmdir <file>")
+	fmt.Printf("rm -r <dir>\n")
+	fmt.Printf("mv [-f] <src> <dst>\n")
+	fmt.Printf("chmod <mode> <path>\n")
+	fmt.Printf("chown <owner>[:<group>] <path>\n")
+	fmt.Printf("quota [<dir> | -u <user>]\n")
+	fmt.Printf("quota set <dir> | -u <user> <bytes> <files>\n")
 	
 	
 }
 
 func rm(line string) bool {
 
+	if strings.HasPrefix(line, "rm -r ") {
+		return rmr(line[len("rm -r"):])
+	}
+
 	file, err1 := parse1args(line)
 
 	if err1 == false {
@@ -144,6 +187,145 @@ func rm(line string) bool {
 
 }
 
+func mv(line string) bool {
+
+	overwrite := false
+	if strings.HasPrefix(line, "mv -f ") {
+		overwrite = true
+		line = "mv " + line[len("mv -f "):]
+	}
+
+	source, dest, err1 := parse2args(line)
+
+	if err1 == false {
+		fmt.Printf("Usage: mv [-f] <src> <dst>\n")
+		return false
+	}
+
+	err := client.Rename(source, dest, overwrite)
+
+	if err == sfs.FAIL {
+		return false
+	}
+
+	return true
+
+}
+
+func chmod(line string) bool {
+
+	mode, file, err1 := parse2args(line)
+
+	if err1 == false {
+		fmt.Printf("Usage: chmod <mode> <path>\n")
+		return false
+	}
+
+	bits, err2 := strconv.Btoui64(mode, 8)
+	if err2 != nil || bits > 0777 {
+		fmt.Printf("Usage: chmod <mode> <path>, mode in octal\n")
+		return false
+	}
+
+	err := client.Chmod(file, bits)
+
+	if err == sfs.FAIL {
+		return false
+	}
+
+	return true
+
+}
+
+func chown(line string) bool {
+
+	who, file, err1 := parse2args(line)
+
+	if err1 == false {
+		fmt.Printf("Usage: chown <owner>[:<group>] <path>\n")
+		return false
+	}
+
+	owner, group := who, ""
+	if i := strings.Index(who, ":"); i != -1 {
+		owner, group = who[:i], who[i+1:]
+	}
+
+	err := client.Chown(file, owner, group)
+
+	if err == sfs.FAIL {
+		return false
+	}
+
+	return true
+
+}
+
+func quota(line string) bool {
+
+	usage := "Usage: quota [set] <dir> | -u <user> [<bytes> <files>]\n"
+	args := strings.Fields(line)[1:]
+
+	set := len(args) > 0 && args[0] == "set"
+	if set {
+		args = args[1:]
+	}
+
+	dir, user := "", ""
+	if len(args) > 0 && args[0] == "-u" {
+		if len(args) < 2 {
+			fmt.Printf(usage)
+			return false
+		}
+		user = args[1]
+		args = args[2:]
+	} else if len(args) > 0 {
+		dir = args[0]
+		args = args[1:]
+	}
+
+	var maxBytes, maxFiles uint64
+	if set {
+		if len(args) != 2 || (dir == "" && user == "") {
+			fmt.Printf(usage)
+			return false
+		}
+		var err1, err2 os.Error
+		maxBytes, err1 = strconv.Atoui64(args[0])
+		maxFiles, err2 = strconv.Atoui64(args[1])
+		if err1 != nil || err2 != nil {
+			fmt.Printf(usage)
+			return false
+		}
+	} else if len(args) != 0 {
+		fmt.Printf(usage)
+		return false
+	}
+
+	quotas, err := client.Quota(dir, user, set, maxBytes, maxFiles)
+
+	if err == sfs.FAIL {
+		return false
+	}
+
+	for _, q := range quotas {
+		name := q.Dir
+		if q.User != "" {
+			name = "user " + q.User
+		}
+		limit := func(max uint64) string {
+			if max == 0 {
+				return "none"
+			}
+			return fmt.Sprintf("%d", max)
+		}
+		fmt.Printf("%-24s %12d bytes (limit %s) %8d files (limit %s)\n", name, q.UsedBytes, limit(q.MaxBytes), q.UsedFiles, limit(q.MaxFiles))
+	}
+
+	return true
+
+}
+
 func rmdir(line string) bool {
 
 	file, err1 := parse1args(line)
@@ -153,7 +335,7 @@ func rmdir(line string) bool {
 		return false
 	}
 	
-	err := client.RemoveDir(file)
+	err := client.RemoveDir(file, false)
 
 	
 	if err == sfs.FAIL {
@@ -165,6 +347,25 @@ func rmdir(line string) bool {
 }
 
 
+func rmr(line string) bool {
+
+	dir, err1 := parse1args(line)
+
+	if err1 == false {
+		fmt.Printf("Usage: rm -r <dir>\n")
+		return false
+	}
+
+	err := client.RemoveDir(dir, true)
+
+	if err == sfs.FAIL {
+		return false
+	}
+
+	return true
+
+}
+
 func mkdir(line string) bool {
 
 	dir, err1 := parse1args(line)
@@ -200,8 +401,11 @@ func put(line string) bool {
 		return false
 	}
 
-	fd := client.Open(dest, client.O_WRONLY|client.O_CREATE)
-	if(fd < 0) {
+	fd := client.Open(dest, client.O_WRONLY|client.O_CREATE|client.O_LEASE_EXCL)
+	if(fd == sfs.QUOTA_EXCEEDED) {
+		fmt.Printf("Open %s in SFS failed: quota exceeded\n", dest)
+		return false
+	} else if(fd < 0) {
 		fmt.Printf("Open %s in SFS failed\n", dest)
 		return false
 	} else {
@@ -210,7 +414,10 @@ func put(line string) bool {
 
 	fmt.Printf("Writing...\n")
 	ret := client.Write(fd, f)
-	if(ret != 0) {
+	if(ret == sfs.QUOTA_EXCEEDED) {
+		fmt.Printf("Write failed: quota exceeded\n")
+		return false
+	} else if(ret != 0) {
 		fmt.Printf("Write failed\n")
 		return false
 	} else {
@@ -275,6 +482,9 @@ func get(line string) bool {
 
 func ls(line string) bool {
 
+	if strings.HasPrefix(line, "ls -l ") {
+		return lsl(line[len("ls -l"):])
+	}
 
 	file, err1 := parse1args(line)
 	
@@ -297,6 +507,36 @@ func ls(line string) bool {
 }
 
 
+func lsl(line string) bool {
+
+	file, err1 := parse1args(line)
+
+	if err1 == false {
+		fmt.Printf("Usage: ls -l <file>\n")
+		return false
+	}
+
+	attr, err := client.Stat(file)
+	if(err != 0) {
+		fmt.Printf("\nCouldn't call Stat on file %s\n", file)
+		return false
+	}
+	if !attr.IsDir {
+		fmt.Printf("%s\n", sfs.LongFormat(attr))
+		return true
+	}
+
+	entries, err := client.ReadDirAttrs(file)
+	if(err != 0) {
+		fmt.Printf("\nCouldn't call ReadDir on file %s*\n", file)
+	}
+
+	for _, a := range entries {
+		fmt.Printf("%s\n", sfs.LongFormat(a))
+	}
+	return true
+}
+
 func parse1args(line string) (string,bool) {
 
 	slice := strings.Index(line," ")
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"../client/client"
+	"../include/sfs"
+	"fmt"
+	"flag"
+	"os"
+)
+
+func main(){
+	server := flag.String("s", "", "specify the chunk server to drain, as host:port (-s)")
+	cancel := flag.Bool("c", false, "put a draining server back in service (-c)")
+	flag.Parse();
+
+	if *server == "" {
+		fmt.Printf("Error, must specify a chunk server.\n")
+		os.Exit(1)
+	}
+
+	status, ok := client.DrainServer(*server, *cancel)
+	if ok == sfs.FAIL {
+		fmt.Printf("Drain %s failed\n", *server)
+		os.Exit(1)
+	}
+
+	if !status.Draining {
+		fmt.Printf("%s is in service\n", *server)
+		os.Exit(0)
+	}
+
+	fmt.Printf("%s is draining: %d chunks held, %d still short elsewhere, %d with no other copy\n",
+		*server, status.Chunks, status.Pending, status.Unique)
+	if status.Done {
+		fmt.Printf("%s can be shut down safely\n", *server)
+	}
+	os.Exit(0)
+}
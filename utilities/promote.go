@@ -0,0 +1,28 @@
+package main
+
+import (
+	"../client/client"
+	"../include/sfs"
+	"fmt"
+	"flag"
+	"os"
+)
+
+func main(){
+	master := flag.String("m", "", "specify the standby master to promote (-m)")
+	force := flag.Bool("f", false, "promote even if the primary still answers (-f)")
+	flag.Parse();
+
+	if *master == "" {
+		fmt.Printf("Error, must specify a master.\n")
+		os.Exit(1)
+	}
+
+	if client.Promote(*master, *force) == sfs.FAIL {
+		fmt.Printf("Promote %s failed\n", *master)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%s is now the primary\n", *master)
+	os.Exit(0)
+}
@@ -23,7 +23,7 @@ func main(){
 		os.Exit(1)
 	}
 
-	fd := client.Open(*dest, client.O_WRONLY|client.O_CREATE)
+	fd := client.Open(*dest, client.O_WRONLY|client.O_CREATE|client.O_LEASE_EXCL)
 	if(fd < 0) {
 		fmt.Printf("Open %s in SFS failed\n", *dest)
 		os.Exit(1)
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"../client/client"
+	"../include/sfs"
+	"fmt"
+	"flag"
+	"os"
+)
+
+func main(){
+	start := flag.Bool("start", false, "start moving chunks onto emptier servers (-start)")
+	stop := flag.Bool("stop", false, "stop the rebalancer (-stop)")
+	budget := flag.Int64("b", 0, "bytes a second the rebalancer may move, 0 for the master's default (-b)")
+	threshold := flag.Float64("t", 0, "fill spread between servers to balance down to, 0 for the master's default (-t)")
+	flag.Parse();
+
+	if *start && *stop {
+		fmt.Printf("Error, can't both start and stop the rebalancer.\n")
+		os.Exit(1)
+	}
+
+	status, ok := client.Rebalance(*start, *stop, *budget, *threshold)
+	if ok == sfs.FAIL {
+		fmt.Printf("Rebalance failed\n")
+		os.Exit(1)
+	}
+
+	state := "stopped"
+	if status.Running {
+		state = "running"
+	}
+	fmt.Printf("rebalancer %s: %d chunks (%d bytes) moved\n", state, status.Moved, status.BytesMoved)
+	os.Exit(0)
+}
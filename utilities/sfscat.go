@@ -4,6 +4,7 @@ import (
 	"../client/client"
 	"fmt"
 	"flag"
+	"io"
 	"os"
 )
 
@@ -15,31 +16,24 @@ func main(){
 
 	flag.Parse();
 
-	client.Initialize(*master)
+	c := client.Initialize(*master)
 
-	fd := client.Open(*file, client.O_RDONLY)
-	if(fd < 0) {
-		fmt.Printf("could not open file %s", *file)
+	f, err := c.Open(*file, client.O_RDONLY)
+	if(err != nil) {
+		fmt.Printf("could not open file %s: %s\n", *file, err.String())
 		os.Exit(1)
 	}
 
 	fmt.Printf("BEGIN OF FILE\n")
-	for ;true; {
-		data, err := client.Read(fd, 1024)
-		if(err != 0) {
-			panic("read failed")
-		}
-		fmt.Printf("%s", string(data))
-		if len(string(data)) == 0 {
-			break
-		}
+	_, err = io.Copy(os.Stdout, f)
+	if(err != nil) {
+		panic("read failed: " + err.String())
 	}
 	fmt.Printf("END OF FILE\n")
 
-	ret := client.Close(fd)
-	if(ret != client.WIN) {
+	err = f.Close()
+	if(err != nil) {
 		panic("close failed")
 	}
 	os.Exit(0)
 }
-
@@ -2,6 +2,7 @@ package main
 
 import (
 	"../client/client"
+	"../include/sfs"
 	"fmt"
 	"flag"
 	"os"
@@ -12,11 +13,32 @@ func main(){
 
 	master := flag.String("m", "", "specify a master!")
 	file := flag.String("f", "", "specify a file (-f)")
+	long := flag.Bool("l", false, "list size, owner, mode and times (-l)")
 
 	flag.Parse();
 
 	client.Initialize(*master)
 
+	if *long {
+		attr, err := client.Stat(*file)
+		if(err != 0) {
+			fmt.Printf("\nCouldn't call Stat on file %s\n", *file)
+			os.Exit(1)
+		}
+		if !attr.IsDir {
+			fmt.Printf("%s\n", sfs.LongFormat(attr))
+			os.Exit(0)
+		}
+
+		entries, err := client.ReadDirAttrs(*file)
+		if(err != 0) {
+			fmt.Printf("\nCouldn't call ReadDir on file %s\n", *file)
+		}
+		for _, a := range entries {
+			fmt.Printf("%s\n", sfs.LongFormat(a))
+		}
+		os.Exit(0)
+	}
 
 	list, err := client.ReadDir(*file)
 	if(err != 0) {